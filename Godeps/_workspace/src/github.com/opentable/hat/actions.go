@@ -0,0 +1,134 @@
+package hat
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Actions are verbs that don't fit CRUD, e.g. restart or rollback. Any method
+// named Do<Action> on an entity is an action, served as
+//
+//	POST /{path to entity}/{action}
+//
+// The method is called on the manifested entity, with the request body bound
+// to its first parameter, which is the action's own payload type, e.g.:
+//
+//	func (a *App) DoRollback(r *Rollback, path []string) error
+//
+// The response is the entity as it is after the action.
+//
+// Resources link to each of their actions, unless the entity has an Actions
+// method, which is called like Manifest and returns the names of the actions
+// that can be done to it now, e.g.:
+//
+//	func (v *Version) Actions(vs *Versions, name string) ([]string, error)
+//
+// Actions that aren't linked can still be POSTed to; it is up to the Do<Action>
+// method to refuse them.
+var action_spec = on(SELF_Manifested).In(IN_Payload).OptIn(IN_Parent, IN_ID, IN_Path, IN_Query, IN_Header).Out(OUT_Error)
+
+const actionPrefix = "Do"
+
+func (n *Node) initActions() error {
+	n.Actions = map[string]*CompiledOp{}
+	if n.IsCollection {
+		return nil
+	}
+	for i := 0; i < n.EntityPtrType.NumMethod(); i++ {
+		m := n.EntityPtrType.Method(i)
+		name, ok := actionName(m.Name)
+		if !ok {
+			continue
+		}
+		if co, err := action_spec.Compile(n, m); err != nil {
+			return err
+		} else {
+			n.Actions[name] = co
+		}
+	}
+	return nil
+}
+
+// actionName turns a method name like DoRollback into the action's URL name,
+// rollback. Methods not named Do<Action> are not actions.
+func actionName(methodName string) (string, bool) {
+	name := strings.TrimPrefix(methodName, actionPrefix)
+	if name == methodName || name == "" || !unicode.IsUpper(rune(name[0])) {
+		return "", false
+	}
+	return strings.ToLower(name), true
+}
+
+// allowedActions is the URL names of the actions that can be done to n now.
+func allowedActions(n *ResolvedSingularNode) ([]string, error) {
+	names := []string{}
+	op, ok := n.Node.Ops["Actions"]
+	if !ok {
+		for name, _ := range n.Node.Actions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	var parent interface{}
+	if n.Parent() != nil {
+		parent = n.Parent().Entity()
+	}
+	_, other, err := op.Invoke(n.Node.Parent.createChildManifestInputs(parent, n.ID(), n.Path()))
+	if err != nil || other == nil {
+		return names, err
+	}
+	for _, name := range other.([]string) {
+		if _, ok := n.Node.Actions[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// locateAction finds the owner of the action named by the last element of
+// path, if there is one. Members take precedence over actions of the same name.
+func locateAction(root *Node, path []string) (owner ResolvedNode, action *CompiledOp, ok bool) {
+	if len(path) < 2 {
+		return nil, nil, false
+	}
+	name := path[len(path)-1]
+	owner, err := LocateFromRoot(root, path[:len(path)-1]...)
+	if err != nil {
+		return nil, nil, false
+	}
+	if _, isMember := owner.UnderlyingNode().Members[name]; isMember {
+		return nil, nil, false
+	}
+	action, ok = owner.UnderlyingNode().Actions[name]
+	return owner, action, ok
+}
+
+// makeACTION performs action on n, which must already exist, or plans it if
+// the request is a dry run.
+func makeACTION(n ResolvedNode, action *CompiledOp, inputs map[IN]boundInput) StdHTTPMethod {
+	return func() (statusCode int, resource *Resource, err error) {
+		if !exists(n) {
+			return 0, nil, HttpError(404, "Not found.")
+		}
+		if dryRun, err := isDryRun(inputs); err != nil {
+			return 0, nil, err
+		} else if dryRun {
+			name, _ := actionName(action.Method.Name)
+			return makePLAN(n, n.UnderlyingNode().Plans[name], false, inputs)()
+		}
+		if _, _, err := action.Invoke(inputs); err != nil {
+			return 0, nil, err
+		}
+		after, err := relocate(n)
+		if err != nil {
+			return 0, nil, err
+		}
+		if r, err := after.Resource(); err != nil {
+			return 0, nil, err
+		} else {
+			return 200, r, nil
+		}
+	}
+}
@@ -1,16 +1,115 @@
 package hat
 
-import "strings"
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
 
 type ResolvedCollectionNode struct {
 	ResolvedNodeBase
 	Collection    interface{} // Manifested collection.
 	CollectionIDs []string    // Manifested collection IDs.
+	PageNum       int         // The page of CollectionIDs to render, starting at 1.
+	Filters       url.Values  // The query the collection was filtered by, if any.
+}
+
+// Filterer is implemented by collections that can be narrowed down by the
+// query of a GET, e.g. ?actor=alice. Filter returns the subset of ids, in the
+// order they should be rendered, that match query.
+type Filterer interface {
+	Filter(ids []string, query url.Values) ([]string, error)
 }
 
 func newResolvedCollection(parent ResolvedNode, node *Node, id string, tag *Tag, collection interface{}, ids []string) ResolvedNode {
 	base := newResolvedNodeBase(parent, node, id, tag)
-	return &ResolvedCollectionNode{base, collection, ids}
+	pageNum := tag.PageNum
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	return &ResolvedCollectionNode{base, collection, ids, pageNum, nil}
+}
+
+// IsPaged is true if the collection's tag specifies a page size.
+func (n *ResolvedCollectionNode) IsPaged() bool {
+	return n.Tag.PageSize > 0
+}
+
+func (n *ResolvedCollectionNode) NumPages() int {
+	if !n.IsPaged() || len(n.CollectionIDs) == 0 {
+		return 1
+	}
+	return (len(n.CollectionIDs) + n.Tag.PageSize - 1) / n.Tag.PageSize
+}
+
+// PageIDs returns the IDs on the current page, in the order the Page op
+// returned them.
+func (n *ResolvedCollectionNode) PageIDs() []string {
+	if !n.IsPaged() {
+		return n.CollectionIDs
+	}
+	start := (n.PageNum - 1) * n.Tag.PageSize
+	if start > len(n.CollectionIDs) {
+		start = len(n.CollectionIDs)
+	}
+	end := start + n.Tag.PageSize
+	if end > len(n.CollectionIDs) {
+		end = len(n.CollectionIDs)
+	}
+	return n.CollectionIDs[start:end]
+}
+
+// filter narrows the collection down by the query of the request, if the
+// collection is a Filterer. The query, less the page number, is kept so that
+// page links stay within the filtered collection.
+func (n *ResolvedCollectionNode) filter(inputs map[IN]boundInput) error {
+	f, ok := n.Collection.(Filterer)
+	if !ok {
+		return nil
+	}
+	q, err := inputs[IN_Query](nil)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	for k, v := range q.(url.Values) {
+		if k != "page" && k != "fields" {
+			query[k] = v
+		}
+	}
+	ids, err := f.Filter(n.CollectionIDs, query)
+	if err != nil {
+		if _, ok := err.(HTTPError); ok {
+			return err
+		}
+		return HttpError(400, err.Error())
+	}
+	n.CollectionIDs, n.Filters = ids, query
+	return nil
+}
+
+// selectPage selects the page asked for in the request, if any.
+func (n *ResolvedCollectionNode) selectPage(inputs map[IN]boundInput) error {
+	page, err := inputs[IN_PageNum](nil)
+	if err != nil {
+		return HttpError(400, err.Error())
+	}
+	if pageNum := page.(int); pageNum != 0 {
+		if pageNum < 1 || pageNum > n.NumPages() {
+			return HttpError(404, "Page", pageNum, "does not exist; there are", n.NumPages(), "pages.")
+		}
+		n.PageNum = pageNum
+	}
+	return nil
+}
+
+func (n *ResolvedCollectionNode) pageLink(rel string, pageNum int) Link {
+	query := url.Values{}
+	for k, v := range n.Filters {
+		query[k] = v
+	}
+	query.Set("page", strconv.Itoa(pageNum))
+	return Link{rel, n.Path() + "?" + query.Encode()}
 }
 
 func (rn *ResolvedCollectionNode) Locate(path ...string) (ResolvedNode, error) {
@@ -46,7 +145,7 @@ func (n *ResolvedCollectionNode) SetEntity(e interface{}) {
 }
 
 func (n *ResolvedCollectionNode) ResolveCollection(tag *Tag, collectionNode *Node, id string) (ResolvedNode, error) {
-	collection, ids, err := collectionNode.ManifestCollection(n.Collection, id)
+	collection, ids, err := collectionNode.ManifestCollection(n.Collection, id, n.Path()+"/"+id)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +156,7 @@ func (n *ResolvedCollectionNode) ResolveCollection(tag *Tag, collectionNode *Nod
 }
 
 func (n *ResolvedCollectionNode) ResolveSingular(tag *Tag, singularNode *Node, id string) (ResolvedNode, error) {
-	entity, err := singularNode.ManifestSingular(n.Collection, id)
+	entity, err := singularNode.ManifestSingular(n.Collection, id, n.Path()+"/"+id)
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +167,17 @@ func (n *ResolvedCollectionNode) ResolveSingular(tag *Tag, singularNode *Node, i
 }
 
 func (n *ResolvedCollectionNode) Links() ([]Link, error) {
-	return []Link{Link{"self", n.Path()}}, nil
+	if !n.IsPaged() {
+		return []Link{Link{"self", n.Path()}}, nil
+	}
+	links := []Link{n.pageLink("self", n.PageNum)}
+	if n.PageNum > 1 {
+		links = append(links, n.pageLink("prev", n.PageNum-1))
+	}
+	if n.PageNum < n.NumPages() {
+		links = append(links, n.pageLink("next", n.PageNum+1))
+	}
+	return links, nil
 }
 
 func (n *ResolvedCollectionNode) Resource() (*Resource, error) {
@@ -105,8 +214,9 @@ func (n *ResolvedCollectionNode) EmbeddedCollectionItems() ([]*Resource, error)
 	if !n.Node.IsCollection {
 		return nil, nil
 	}
-	items := make([]*Resource, len(n.CollectionIDs))
-	for i, id := range n.CollectionIDs {
+	ids := n.PageIDs()
+	items := make([]*Resource, len(ids))
+	for i, id := range ids {
 		if childNode, err := n.Resolve(id); err != nil {
 			return nil, err
 		} else {
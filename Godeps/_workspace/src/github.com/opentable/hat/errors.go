@@ -28,6 +28,54 @@ func (he httpError) Err() error {
 	return he.hatError
 }
 
+// ValidationError rejects a payload with 422 Unprocessable Entity, listing
+// every field that is wrong with it. Validate ops should Add to one and
+// return its OrNil.
+type ValidationError struct {
+	Message string
+	Errors  []FieldError
+}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func NewValidationError(args ...interface{}) *ValidationError {
+	return &ValidationError{Message: msgS(args...)}
+}
+
+// Add records that field is invalid; args are joined with spaces to make
+// the message.
+func (ve *ValidationError) Add(field string, args ...interface{}) {
+	ve.Errors = append(ve.Errors, FieldError{field, msgS(args...)})
+}
+
+// OrNil returns nil if no field errors have been added, so that it can be
+// returned directly from a Validate op.
+func (ve *ValidationError) OrNil() error {
+	if len(ve.Errors) == 0 {
+		return nil
+	}
+	return ve
+}
+
+func (ve *ValidationError) Error() string {
+	fields := make([]string, len(ve.Errors))
+	for i, fe := range ve.Errors {
+		fields[i] = fe.Field + ": " + fe.Message
+	}
+	return ve.Message + " " + strings.Join(fields, "; ")
+}
+
+func (ve *ValidationError) StatusCode() int {
+	return 422
+}
+
+func (ve *ValidationError) Err() error {
+	return ve
+}
+
 func (h hatError) Error() string {
 	return h.Message
 }
@@ -1,20 +1,32 @@
 package hat
 
 import (
+	"net/http"
 	"strings"
 )
 
 type inBinder func(ResolvedNode) map[IN]boundInput
 
-func ExecuteRequest(root *Node, path string, method string, inputBinder inBinder) (int, *Resource, error) {
-	target, err := LocateFromRoot(root, strings.Split(path[1:], "/")...)
-	if err != nil {
+func ExecuteRequest(root *Node, path string, method string, header http.Header, inputBinder inBinder) (int, *Resource, error) {
+	parts := strings.Split(path[1:], "/")
+	target, err := LocateFromRoot(root, parts...)
+	var methods map[string]StdHTTPMethod
+	if err == nil {
+		methods = makeHTTPMethods(target, inputBinder(target))
+	} else if owner, action, ok := locateAction(root, parts); ok {
+		// Preconditions on an action apply to the resource it acts on.
+		target = owner
+		methods = map[string]StdHTTPMethod{"POST": makeACTION(owner, action, inputBinder(owner))}
+	} else {
 		return 0, nil, err
 	}
-	methods := makeHTTPMethods(target, inputBinder(target))
 
 	if m, ok := methods[method]; !ok {
 		return 0, nil, HttpError(405, path+" does not support method "+method+"; it does support: "+supportedMethods(methods))
+	} else if method == "GET" {
+		return m()
+	} else if err := checkPreconditions(target, header); err != nil {
+		return 0, nil, err
 	} else {
 		return m()
 	}
@@ -32,6 +32,11 @@ func NewFieldFilter(csv string) *fieldFilter {
 func (ff *fieldFilter) Enter(fieldName string) *fieldFilter {
 	newFields := []string{}
 	for _, filter := range ff.Fields {
+		if filter == "*" {
+			// Everything is allowed all the way down.
+			newFields = append(newFields, filter)
+			continue
+		}
 		parts := strings.SplitN(filter, ".", 2)
 		if len(parts) == 2 && parts[0] == fieldName {
 			newFields = append(newFields, parts[1])
@@ -50,8 +55,17 @@ func (ff *fieldFilter) Allows(fieldName string) bool {
 	return false
 }
 
+func (ff *fieldFilter) allowsAll() bool {
+	for _, filter := range ff.Fields {
+		if filter == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func (ff *fieldFilter) Filter(v interface{}) (interface{}, error) {
-	if len(ff.Fields) == 0 {
+	if len(ff.Fields) == 0 || ff.allowsAll() {
 		// No more filters, so return whole value
 		return v, nil
 	}
@@ -1,6 +1,8 @@
 package hat
 
 import (
+	"net/http"
+	"net/url"
 	"reflect"
 )
 
@@ -12,6 +14,9 @@ const (
 	IN_ID       = IN(iota)
 	IN_PageNum  = IN(iota)
 	ON_PageSize = IN(iota)
+	IN_Path     = IN(iota)
+	IN_Query    = IN(iota)
+	IN_Header   = IN(iota)
 )
 
 func (in IN) Accepts(n *Node, name string, pos int, t reflect.Type) error {
@@ -43,6 +48,21 @@ func (in IN) Accepts(n *Node, name string, pos int, t reflect.Type) error {
 		if t.Kind() != reflect.Int {
 			return n.MethodError(name, "expects an int at position", pos)
 		}
+
+	case IN_Path:
+		if t.Kind() != reflect.Slice || t.Elem().Kind() != reflect.String {
+			return n.MethodError(name, "expects a []string at position", pos)
+		}
+
+	case IN_Query:
+		if t != reflect.TypeOf(url.Values{}) {
+			return n.MethodError(name, "expects url.Values at position", pos)
+		}
+
+	case IN_Header:
+		if t != reflect.TypeOf(http.Header{}) {
+			return n.MethodError(name, "expects http.Header at position", pos)
+		}
 	}
 	return nil
 }
@@ -1,6 +1,9 @@
 package hat
 
-import "reflect"
+import (
+	"reflect"
+	"strings"
+)
 
 type StdHTTPMethod func() (statusCode int, resource *Resource, err error)
 
@@ -10,13 +13,29 @@ func makeHTTPMethods(n ResolvedNode, inputs map[IN]boundInput) map[string]StdHTT
 	}
 	if _, ok := n.UnderlyingNode().Ops["Write"]; ok {
 		methods["PUT"] = makePUT(n, inputs)
+		if !n.UnderlyingNode().Tag.Immutable {
+			methods["PATCH"] = makePATCH(n, inputs)
+		}
+	}
+	if _, ok := n.UnderlyingNode().Ops["Delete"]; ok {
+		methods["DELETE"] = makeDELETE(n, inputs)
 	}
 	return methods
 }
 
 func makeGET(n ResolvedNode, inputs map[IN]boundInput) StdHTTPMethod {
 	return func() (statusCode int, resource *Resource, err error) {
-		if !n.UnderlyingNode().IsCollection && reflect.DeepEqual(reflect.ValueOf(n.Entity()).Elem().Interface(), reflect.Zero(n.UnderlyingNode().EntityType).Interface()) {
+		if c, ok := n.(*ResolvedCollectionNode); ok {
+			if err := c.filter(inputs); err != nil {
+				return 0, nil, err
+			}
+			if c.IsPaged() {
+				if err := c.selectPage(inputs); err != nil {
+					return 0, nil, err
+				}
+			}
+		}
+		if !exists(n) {
 			return 0, nil, HttpError(404, "Not found.")
 		}
 		if r, err := n.Resource(); err != nil {
@@ -29,22 +48,31 @@ func makeGET(n ResolvedNode, inputs map[IN]boundInput) StdHTTPMethod {
 
 func makePUT(n ResolvedNode, inputs map[IN]boundInput) StdHTTPMethod {
 	return func() (statusCode int, resource *Resource, err error) {
+		if dryRun, err := isDryRun(inputs); err != nil {
+			return 0, nil, err
+		} else if dryRun {
+			return makePLAN(n, n.UnderlyingNode().Ops["Plan"], true, inputs)()
+		}
 		successStatus := 200
-		if n.Entity() == nil {
+		if !exists(n) {
 			successStatus = 201
 		}
+		if validate, ok := n.UnderlyingNode().Ops["Validate"]; ok {
+			if _, _, err := validate.Invoke(inputs); err != nil {
+				return 0, nil, err
+			}
+		}
 		op := n.UnderlyingNode().Ops["Write"]
-		_, _, err = op.Invoke(inputs)
-		//n.SetEntity(entity)
-		entity, err := n.UnderlyingNode().Manifest(n.Parent().Entity(), n.ID())
-		if err != nil {
+		if _, _, err := op.Invoke(inputs); err != nil {
 			return 0, nil, err
 		}
-		n.SetEntity(entity)
+		// Everything above n was manifested before the write, so start again
+		// from the root to see what was written.
+		written, err := relocate(n)
 		if err != nil {
 			return 0, nil, err
 		}
-		if r, err := n.Resource(); err != nil {
+		if r, err := written.Resource(); err != nil {
 			return 0, nil, err
 		} else {
 			return successStatus, r, nil
@@ -52,7 +80,39 @@ func makePUT(n ResolvedNode, inputs map[IN]boundInput) StdHTTPMethod {
 	}
 }
 
-func (parentNode *Node) createChildManifestInputs(parentEntity interface{}, id string) map[IN]boundInput {
+// makePATCH writes the existing entity with a JSON merge patch applied to it;
+// the patching itself happens when the payload is bound.
+func makePATCH(n ResolvedNode, inputs map[IN]boundInput) StdHTTPMethod {
+	put := makePUT(n, inputs)
+	return func() (statusCode int, resource *Resource, err error) {
+		if !exists(n) {
+			return 0, nil, HttpError(404, "Not found.")
+		}
+		return put()
+	}
+}
+
+// makeDELETE responds with the resource as it was just before it was deleted.
+func makeDELETE(n ResolvedNode, inputs map[IN]boundInput) StdHTTPMethod {
+	return func() (statusCode int, resource *Resource, err error) {
+		if dryRun, err := isDryRun(inputs); err != nil {
+			return 0, nil, err
+		} else if dryRun {
+			return makePLAN(n, nil, false, inputs)()
+		}
+		r, err := n.Resource()
+		if err != nil {
+			return 0, nil, err
+		}
+		op := n.UnderlyingNode().Ops["Delete"]
+		if _, _, err := op.Invoke(inputs); err != nil {
+			return 0, nil, err
+		}
+		return 200, r, nil
+	}
+}
+
+func (parentNode *Node) createChildManifestInputs(parentEntity interface{}, id string, path string) map[IN]boundInput {
 	if parentEntity == nil && parentNode != nil {
 		parentEntity = reflect.New(parentNode.EntityType).Interface()
 	}
@@ -66,5 +126,18 @@ func (parentNode *Node) createChildManifestInputs(parentEntity interface{}, id s
 		IN_PageNum: func(_ *BoundOp) (interface{}, error) {
 			return 1, nil
 		},
+		IN_Path: func(_ *BoundOp) (interface{}, error) {
+			return splitPath(path), nil
+		},
+	}
+}
+
+// splitPath turns a resolved node path like /pools/a/apps into its IDs,
+// e.g. [pools a apps].
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return []string{}
 	}
+	return strings.Split(path, "/")
 }
@@ -10,6 +10,8 @@ type Node struct {
 	EntityType     reflect.Type
 	EntityPtrType  reflect.Type
 	Ops            map[string]*CompiledOp
+	Actions        map[string]*CompiledOp // By URL name.
+	Plans          map[string]*CompiledOp // Of actions, by URL name.
 	Members        map[string]*Member
 	Collection     *Member
 	CollectionName string
@@ -97,30 +99,39 @@ func LocateFromRoot(root *Node, path ...string) (ResolvedNode, error) {
 	}
 }
 
+// relocate resolves the node at n's path afresh, from the root.
+func relocate(n ResolvedNode) (ResolvedNode, error) {
+	root := n
+	for root.Parent() != nil {
+		root = root.Parent()
+	}
+	return LocateFromRoot(root.UnderlyingNode(), splitPath(n.Path())...)
+}
+
 func ResolveRoot(root *Node) (ResolvedNode, error) {
-	entity, err := root.ManifestSingular(nil, "")
+	entity, err := root.ManifestSingular(nil, "", "")
 	if err != nil {
 		return nil, err
 	}
 	return newResolvedSingular(nil, root, "", &Tag{}, entity), nil
 }
 
-func (n *Node) Manifest(parent interface{}, id string) (interface{}, error) {
+func (n *Node) Manifest(parent interface{}, id string, path string) (interface{}, error) {
 	if n.IsCollection {
-		entity, _, err := n.ManifestCollection(parent, id)
+		entity, _, err := n.ManifestCollection(parent, id, path)
 		return entity, err
 	}
-	return n.ManifestSingular(parent, id)
+	return n.ManifestSingular(parent, id, path)
 }
 
-func (n *Node) ManifestSingular(parentEntity interface{}, id string) (interface{}, error) {
-	inputs := n.createChildManifestInputs(parentEntity, id)
+func (n *Node) ManifestSingular(parentEntity interface{}, id string, path string) (interface{}, error) {
+	inputs := n.createChildManifestInputs(parentEntity, id, path)
 	entity, _, err := n.Ops["Manifest"].Invoke(inputs)
 	return entity, err
 }
 
-func (n *Node) ManifestCollection(parentCollection interface{}, id string) (collection interface{}, ids []string, err error) {
-	inputs := n.createChildManifestInputs(parentCollection, id)
+func (n *Node) ManifestCollection(parentCollection interface{}, id string, path string) (collection interface{}, ids []string, err error) {
+	inputs := n.createChildManifestInputs(parentCollection, id, path)
 	entity, other, err := n.Ops["Page"].Invoke(inputs)
 	if err != nil {
 		return nil, nil, err
@@ -133,6 +144,12 @@ func (n *Node) init() error {
 	if err := n.initOps(); err != nil {
 		return err
 	}
+	if err := n.initPlans(); err != nil {
+		return err
+	}
+	if err := n.initActions(); err != nil {
+		return err
+	}
 	if err := n.initMembers(); err != nil {
 		return err
 	}
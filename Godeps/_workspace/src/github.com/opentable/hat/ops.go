@@ -1,10 +1,18 @@
 package hat
 
 var op_specs = map[string]*Op{
-	"Manifest": on(SELF_Nil).In().OptIn(IN_Parent, IN_ID).Out(OUT_Error).
+	"Manifest": on(SELF_Nil).In().OptIn(IN_Parent, IN_ID, IN_Path).Out(OUT_Error).
 		RequireIf(func(n *Node) bool { return !n.IsCollection }),
-	"Page": on(SELF_Nil).In().OptIn(IN_PageNum, IN_Parent, IN_ID).Out(OUT_OtherEntity, OUT_Error).
+	"Page": on(SELF_Nil).In().OptIn(IN_PageNum, IN_Parent, IN_ID, IN_Path).Out(OUT_OtherEntity, OUT_Error).
 		RequireIf(func(n *Node) bool { return n.IsCollection }),
-	"Write": on(SELF_Payload).In().OptIn(IN_Parent, IN_ID).Out(OUT_Error).
+	"Write": on(SELF_Payload).In().OptIn(IN_Parent, IN_ID, IN_Path, IN_Header).Out(OUT_Error).
+		RequireIf(func(n *Node) bool { return false }),
+	"Plan": on(SELF_Payload).In().OptIn(IN_Parent, IN_ID, IN_Path).Out(OUT_OtherEntity, OUT_Error).
+		RequireIf(func(n *Node) bool { return false }),
+	"Validate": on(SELF_Payload).In().OptIn(IN_Parent, IN_ID, IN_Path).Out(OUT_Error).
+		RequireIf(func(n *Node) bool { return false }),
+	"Actions": on(SELF_Manifested).In().OptIn(IN_Parent, IN_ID, IN_Path).Out(OUT_OtherEntity, OUT_Error).
+		RequireIf(func(n *Node) bool { return false }),
+	"Delete": on(SELF_Manifested).In().OptIn(IN_Parent, IN_ID, IN_Path, IN_Query).Out(OUT_Error).
 		RequireIf(func(n *Node) bool { return false }),
 }
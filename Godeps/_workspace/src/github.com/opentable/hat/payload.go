@@ -17,10 +17,56 @@ func newPayload(r *http.Request) *Payload {
 	return &Payload{r.Body, r.Header.Get("Content-Type")}
 }
 
+// MergePatch applies the payload, as a JSON merge patch (RFC 7386), to the
+// JSON representation of current, and returns the result as a new t.
+func (p *Payload) MergePatch(current interface{}, t reflect.Type) (interface{}, error) {
+	var target, patch interface{}
+	if data, err := json.Marshal(current); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &target); err != nil {
+		return nil, err
+	}
+	if data, err := ioutil.ReadAll(p.Body); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, HttpError(400, "Merge patch is not valid JSON:", err)
+	}
+	v := reflect.New(t).Interface()
+	if data, err := json.Marshal(mergePatch(target, patch)); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &v); err != nil {
+		return nil, HttpError(400, "Merge patch does not fit", t, err)
+	}
+	return v, nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// Manifest decodes the payload into a new t. An empty payload, e.g. a POST
+// with nothing to say, is the zero t.
 func (p *Payload) Manifest(t reflect.Type) (interface{}, error) {
 	v := reflect.New(t).Interface()
 	if data, err := ioutil.ReadAll(p.Body); err != nil {
 		return nil, err
+	} else if len(data) == 0 {
+		return v, nil
 	} else if err := json.Unmarshal(data, &v); err != nil {
 		return nil, err
 	} else {
@@ -0,0 +1,97 @@
+package hat
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Plans say what a PUT, PATCH or action would do, without doing it. They are
+// asked for with ?dryRun=true. A PUT or PATCH is planned by the entity's Plan
+// method, which is called like Write, after Validate, e.g.:
+//
+//	func (v *Version) Plan(vs *Versions, name string) (*Plan, error)
+//
+// and an action by a Plan<Action> method, called like Do<Action>:
+//
+//	func (a *App) PlanRollback(r *Rollback, path []string) (*Plan, error)
+//
+// The response is the plan, with a link to the resource it is for. Requests
+// that can't be planned are refused, rather than done for real.
+var plan_action_spec = on(SELF_Manifested).In(IN_Payload).OptIn(IN_Parent, IN_ID, IN_Path, IN_Query).Out(OUT_OtherEntity, OUT_Error)
+
+const (
+	planPrefix  = "Plan"
+	dryRunParam = "dryRun"
+)
+
+func (n *Node) initPlans() error {
+	n.Plans = map[string]*CompiledOp{}
+	if n.IsCollection {
+		return nil
+	}
+	for i := 0; i < n.EntityPtrType.NumMethod(); i++ {
+		m := n.EntityPtrType.Method(i)
+		name, ok := planName(m.Name)
+		if !ok {
+			continue
+		}
+		if co, err := plan_action_spec.Compile(n, m); err != nil {
+			return err
+		} else {
+			n.Plans[name] = co
+		}
+	}
+	return nil
+}
+
+// planName turns a method name like PlanRollback into the URL name of the
+// action it plans, rollback.
+func planName(methodName string) (string, bool) {
+	name := strings.TrimPrefix(methodName, planPrefix)
+	if name == methodName {
+		return "", false
+	}
+	return actionName(actionPrefix + name)
+}
+
+// DryRun is true if query asks for a plan rather than the real thing.
+func DryRun(query url.Values) (bool, error) {
+	v := query.Get(dryRunParam)
+	if v == "" {
+		return false, nil
+	}
+	if dryRun, err := strconv.ParseBool(v); err != nil {
+		return false, HttpError(400, dryRunParam, quot(v), "not recognised; expected true or false.")
+	} else {
+		return dryRun, nil
+	}
+}
+
+func isDryRun(inputs map[IN]boundInput) (bool, error) {
+	if query, err := inputs[IN_Query](nil); err != nil {
+		return false, err
+	} else {
+		return DryRun(query.(url.Values))
+	}
+}
+
+// makePLAN responds with what plan, if there is one, says would happen to n.
+// The payload of a PUT or PATCH is validated first.
+func makePLAN(n ResolvedNode, plan *CompiledOp, validate bool, inputs map[IN]boundInput) StdHTTPMethod {
+	return func() (statusCode int, resource *Resource, err error) {
+		if plan == nil {
+			return 0, nil, HttpError(400, n.Path(), "does not support", dryRunParam+".")
+		}
+		if v, ok := n.UnderlyingNode().Ops["Validate"]; ok && validate {
+			if _, _, err := v.Invoke(inputs); err != nil {
+				return 0, nil, err
+			}
+		}
+		_, p, err := plan.Invoke(inputs)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, &Resource{"plan", p, nil, nil, []Link{{"target", n.Path()}}}, nil
+	}
+}
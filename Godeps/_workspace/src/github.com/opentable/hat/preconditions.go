@@ -0,0 +1,76 @@
+package hat
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ETag is a strong entity tag for the resource, derived from its full HAL
+// rendering, so it changes whenever anything a client could see changes.
+func ETag(r *Resource) (string, error) {
+	hal, err := RenderAsHAL(r, NewFieldFilter(""))
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(hal)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
+// exists is false for singular nodes whose manifested entity is the zero
+// value of its type; collections always exist.
+func exists(n ResolvedNode) bool {
+	if n.UnderlyingNode().IsCollection {
+		return true
+	}
+	return !reflect.DeepEqual(reflect.ValueOf(n.Entity()).Elem().Interface(), reflect.Zero(n.UnderlyingNode().EntityType).Interface())
+}
+
+// checkPreconditions enforces If-Match and If-None-Match against the current
+// state of n, before any change is made to it.
+func checkPreconditions(n ResolvedNode, header http.Header) error {
+	ifMatch, ifNoneMatch := header.Get("If-Match"), header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	if !exists(n) {
+		if ifMatch != "" {
+			return HttpError(412, n.Path(), "does not exist; If-Match failed.")
+		}
+		return nil
+	}
+	r, err := n.Resource()
+	if err != nil {
+		return err
+	}
+	etag, err := ETag(r)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && !matchesETag(ifMatch, etag) {
+		return HttpError(412, n.Path(), "has changed; its ETag is now", etag)
+	}
+	if ifNoneMatch != "" && matchesETag(ifNoneMatch, etag) {
+		return HttpError(412, n.Path(), "already exists with ETag", etag)
+	}
+	return nil
+}
+
+// matchesETag is true if etag is in the comma-separated list of tags given
+// in an If-Match or If-None-Match header, or if that list is "*".
+func matchesETag(list, etag string) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -8,6 +8,8 @@ import (
 	"strings"
 )
 
+const halMimeType = "application/hal+json"
+
 type Server struct {
 	root *Node
 }
@@ -32,13 +34,21 @@ func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//acceptType := getMediaType(r.Header.Get("Accept"))
 	fieldFilters := NewFieldFilter(r.URL.Query().Get("fields"))
 	//embedFilters := NewEmbedFilter(r.URL.Query().Get("embed"))
-	if statusCode, resource, err := ExecuteRequest(s.root, r.URL.Path, r.Method, inputBinder); err != nil {
+	if statusCode, resource, err := ExecuteRequest(s.root, r.URL.Path, r.Method, r.Header, inputBinder); err != nil {
 		writeError(w, err)
 	} else if hal, err := RenderAsHAL(resource, fieldFilters); err != nil {
 		writeError(w, err)
 	} else {
-		halMimeType := "application/hal+json"
 		w.Header().Add("Content-Type", halMimeType)
+		// A deleted resource no longer has a current representation.
+		if r.Method != "DELETE" {
+			if etag, err := ETag(resource); err != nil {
+				writeError(w, err)
+				return
+			} else {
+				w.Header().Set("ETag", etag)
+			}
+		}
 		writeResponse(w, statusCode, hal)
 	}
 }
@@ -47,6 +57,9 @@ type boundInput func(*BoundOp) (interface{}, error)
 
 func makeInputBinder(r *http.Request) func(ResolvedNode) map[IN]boundInput {
 	return func(n ResolvedNode) map[IN]boundInput {
+		// The body can only be read once, so every op that takes the payload,
+		// e.g. Validate then Write, gets the same one.
+		payloads := map[reflect.Type]interface{}{}
 		return map[IN]boundInput{
 			IN_Parent: func(bo *BoundOp) (interface{}, error) {
 				return n.Parent().Entity(), nil
@@ -54,6 +67,15 @@ func makeInputBinder(r *http.Request) func(ResolvedNode) map[IN]boundInput {
 			IN_ID: func(*BoundOp) (interface{}, error) {
 				return n.ID(), nil
 			},
+			IN_Path: func(*BoundOp) (interface{}, error) {
+				return splitPath(n.Path()), nil
+			},
+			IN_Query: func(*BoundOp) (interface{}, error) {
+				return r.URL.Query(), nil
+			},
+			IN_Header: func(*BoundOp) (interface{}, error) {
+				return r.Header, nil
+			},
 			IN_Payload: func(bo *BoundOp) (interface{}, error) {
 				// TODO: These methods should all be compiled at the compile step.
 				payload := newPayload(r)
@@ -61,11 +83,26 @@ func makeInputBinder(r *http.Request) func(ResolvedNode) map[IN]boundInput {
 				if bo.Compiled.Def.RequiresPayloadReceiver() {
 					t = bo.Compiled.Node.EntityType
 				} else if bo.Compiled.Def.Requires(IN_Payload) {
-					t = bo.Compiled.OtherEntityType
+					// IN_Payload parameters are always pointers.
+					t = bo.Compiled.OtherEntityType.Elem()
 				} else {
 					return nil, bo.Compiled.Error("bindInputs: unable to determine required payload type")
 				}
-				return payload.Manifest(t)
+				if p, ok := payloads[t]; ok {
+					return p, nil
+				}
+				var p interface{}
+				var err error
+				if r.Method == "PATCH" {
+					p, err = payload.MergePatch(n.Entity(), t)
+				} else {
+					p, err = payload.Manifest(t)
+				}
+				if err != nil {
+					return nil, err
+				}
+				payloads[t] = p
+				return p, nil
 			},
 			IN_PageNum: func(*BoundOp) (interface{}, error) {
 				if n := r.URL.Query().Get("page"); len(n) == 0 {
@@ -73,14 +110,22 @@ func makeInputBinder(r *http.Request) func(ResolvedNode) map[IN]boundInput {
 				} else if page, err := strconv.ParseInt(n, 10, 32); err != nil {
 					return 0, Error("Page number", quot(n), "not recognised; expected integer:", err)
 				} else {
-					return page, nil
+					return int(page), nil
 				}
 			},
 		}
 	}
 }
 
+// WriteError responds with err as the Server responds with errors from ops,
+// so that handlers in front of a Server can fail in the same form. HTTPErrors
+// keep their status code; any other error is a 500.
+func WriteError(w http.ResponseWriter, err error) {
+	writeError(w, err)
+}
+
 func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", halMimeType)
 	if httpErr, ok := err.(HTTPError); ok {
 		writeResponse(w, httpErr.StatusCode(), httpErr.Err())
 	} else {
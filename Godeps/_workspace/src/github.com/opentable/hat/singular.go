@@ -47,7 +47,7 @@ func (n *ResolvedSingularNode) SetEntity(e interface{}) {
 }
 
 func (n *ResolvedSingularNode) ResolveCollection(tag *Tag, collectionNode *Node, id string) (ResolvedNode, error) {
-	collection, ids, err := collectionNode.ManifestCollection(n.Entity(), id)
+	collection, ids, err := collectionNode.ManifestCollection(n.Entity(), id, n.Path()+"/"+id)
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +55,7 @@ func (n *ResolvedSingularNode) ResolveCollection(tag *Tag, collectionNode *Node,
 }
 
 func (n *ResolvedSingularNode) ResolveSingular(tag *Tag, singularNode *Node, id string) (ResolvedNode, error) {
-	entity, err := singularNode.ManifestSingular(n.Entity(), id)
+	entity, err := singularNode.ManifestSingular(n.Entity(), id, n.Path()+"/"+id)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +73,13 @@ func (n *ResolvedSingularNode) Links() ([]Link, error) {
 			links = append(links, Link{rel, n.Path() + "/" + name})
 		}
 	}
+	actions, err := allowedActions(n)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range actions {
+		links = append(links, Link{name, n.Path() + "/" + name})
+	}
 	return links, nil
 }
 
@@ -13,6 +13,7 @@ type Tag struct {
 	Page        bool
 	PageNum     int
 	PageSize    int
+	Immutable   bool // Items can be created with PUT, but not PATCHed.
 }
 
 func newTag(rel string, datum string) (*Tag, error) {
@@ -48,9 +49,10 @@ func parseTagDirective(data string, tag *Tag) error {
 }
 
 var tagMap = map[string]func(string, *Tag) error{
-	"embed": embedTag,
-	"link":  linkTag,
-	"page":  pageTag,
+	"embed":     embedTag,
+	"link":      linkTag,
+	"page":      pageTag,
+	"immutable": immutableTag,
 }
 
 func embedTag(params string, tag *Tag) error {
@@ -72,6 +74,16 @@ func linkTag(params string, tag *Tag) error {
 	return nil
 }
 
+// immutableTag is for collections whose items, once created, can't be
+// changed; PATCH is not served for them.
+func immutableTag(params string, tag *Tag) error {
+	if len(params) != 0 {
+		return Error("immutable tag; got params", params, "expected no parameters")
+	}
+	tag.Immutable = true
+	return nil
+}
+
 func pageTag(params string, tag *Tag) error {
 	tag.Page = true
 	parts := strings.Split(params, ",")
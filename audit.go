@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/opentable/hat"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// actorHeader names whoever made a request. It is set from the key the
+// request was authenticated with.
+const actorHeader = "X-Deploy-Actor"
+
+// requestIDHeader carries the ID of a request, if the client gave it one; the
+// response always has one.
+const requestIDHeader = "X-Request-Id"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type AuditLog map[string]*AuditRecord
+
+// AuditRecord is a successful change to a pool, app or version: who made it,
+// when, from where, and what it changed.
+type AuditRecord struct {
+	ID        string                 `json:"id"`
+	RequestID string                 `json:"requestId"`
+	Actor     string                 `json:"actor"`
+	At        time.Time              `json:"at"`
+	SourceIP  string                 `json:"sourceIp"`
+	Method    string                 `json:"method"`
+	Path      string                 `json:"path"`
+	Status    int                    `json:"status"`
+	Pool      string                 `json:"pool"`
+	App       string                 `json:"app,omitempty"`
+	Version   string                 `json:"version,omitempty"`
+	Action    string                 `json:"action,omitempty"`
+	Diff      map[string]FieldChange `json:"diff"`
+}
+
+// FieldChange is the value of a field of an entity before and after a
+// change; either is null if the entity didn't exist.
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// audited wraps handler so that every successful PUT, PATCH, DELETE or action
+// on a pool, app or version is recorded in the audit log. It holds the pool's
+// lock throughout, so that the diff is of this request's change alone.
+func audited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := newAuditRecord(r)
+		w.Header().Set(requestIDHeader, rec.RequestID)
+		// Dry runs change nothing.
+		dryRun, _ := hat.DryRun(r.URL.Query())
+		if r.Method == "GET" || r.Method == "HEAD" || rec.Pool == "" || dryRun {
+			handler(w, r)
+			return
+		}
+		defer state.LockPoolFor(rec)()
+		before := snapshot(rec.Pool, rec.App, rec.Version)
+		sw := &statusWriter{w, 200}
+		handler(sw, r)
+		if sw.status < 200 || sw.status > 299 {
+			return
+		}
+		rec.Status = sw.status
+		rec.Diff = diff(before, snapshot(rec.Pool, rec.App, rec.Version))
+		if err := state.AddAuditRecord(rec); err != nil {
+			log.Error(err)
+		}
+		auditLog.Info(r, rec)
+	}
+}
+
+// newAuditRecord works out who is doing what to which entity from the
+// request. Pool is empty if the request isn't to a pool or anything in one.
+func newAuditRecord(r *http.Request) *AuditRecord {
+	rec := &AuditRecord{
+		ID:       newID(),
+		Actor:    actorOf(r.Header),
+		At:       time.Now().UTC(),
+		SourceIP: sourceIP(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+	}
+	if rec.RequestID = r.Header.Get(requestIDHeader); !validRequestID.MatchString(rec.RequestID) {
+		rec.RequestID = rec.ID
+	}
+	// The path is /pools/{pool}/apps/{app}/versions/{version}, or a prefix
+	// of it, maybe followed by the name of an action.
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "pools" {
+		return rec
+	}
+	if len(path)%2 == 1 {
+		rec.Action = path[len(path)-1]
+		path = path[:len(path)-1]
+	}
+	rec.Pool, rec.App, rec.Version = pathIDs(path)
+	return rec
+}
+
+// systemActor is the actor of changes deploy makes of its own accord, e.g.
+// to correct drift, or sync pools from the config repo.
+const systemActor = "deploy"
+
+// actorOf is whoever made a request, from its headers.
+func actorOf(h http.Header) string {
+	if actor := h.Get(actorHeader); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+const idTimeFormat = "20060102T150405.000000Z"
+
+// newID is unique, and sorts in the order IDs were made. It identifies audit
+// records and events.
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format(idTimeFormat) + "-" + hex.EncodeToString(b)
+}
+
+// trustedProxies are the proxies whose X-Forwarded-For headers are believed.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges, e.g. "10.0.0.1,192.168.0.0/16".
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if strings.Contains(p, "/") {
+			_, n, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q is not a CIDR range: %s", p, err)
+			}
+			proxies = append(proxies, n)
+		} else if ip := net.ParseIP(p); ip != nil {
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address", p)
+		}
+	}
+	return proxies, nil
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceIP is the address the request came from. Each proxy adds the address
+// it got the request from to X-Forwarded-For, so that is followed back only
+// for as long as the request came from a trusted proxy; anyone can send an
+// X-Forwarded-For.
+func sourceIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(ip); i-- {
+		if f := strings.TrimSpace(forwarded[i]); f != "" {
+			ip = f
+		}
+	}
+	return ip
+}
+
+// snapshot is the JSON of the entity with the given IDs, as fields, or nil
+// if it doesn't exist.
+func snapshot(poolID, appID, versionID string) map[string]interface{} {
+	var entity interface{}
+	switch {
+	case versionID != "":
+		if v := state.GetVersion(poolID, appID, versionID); v != nil {
+			entity = v
+		}
+	case appID != "":
+		if a := state.GetApp(poolID, appID); a != nil {
+			entity = a
+		}
+	default:
+		if p := state.GetPool(poolID); p != nil {
+			entity = p
+		}
+	}
+	if entity == nil {
+		return nil
+	}
+	return fields(entity)
+}
+
+// fields is the JSON of entity, as fields.
+func fields(entity interface{}) map[string]interface{} {
+	f := map[string]interface{}{}
+	if data, err := json.Marshal(entity); err != nil {
+		log.Error(err)
+	} else if err := json.Unmarshal(data, &f); err != nil {
+		log.Error(err)
+	}
+	return f
+}
+
+// diff is the fields that differ between two snapshots. A field missing from
+// either is null.
+func diff(before, after map[string]interface{}) map[string]FieldChange {
+	d := map[string]FieldChange{}
+	for _, fields := range []map[string]interface{}{before, after} {
+		for k, _ := range fields {
+			if b, a := before[k], after[k]; !reflect.DeepEqual(b, a) {
+				d[k] = FieldChange{b, a}
+			}
+		}
+	}
+	return d
+}
+
+// statusWriter remembers the status code of the response it writes.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// commitMessage describes the record as a git commit, with its details as
+// trailers, so that the state repo's log is itself an audit log.
+func (rec *AuditRecord) commitMessage() string {
+	return fmt.Sprintf("%s %s by %s\n\n%sStatus: %d\n", rec.Method, rec.Path, rec.Actor, rec.commitTrailers(), rec.Status)
+}
+
+// commitTrailers are the details of the request, as git trailers. They are
+// also added to the commits of the changes the request makes.
+func (rec *AuditRecord) commitTrailers() string {
+	return fmt.Sprintf("Request-Id: %s\nActor: %s\nSource-Ip: %s\n", rec.RequestID, rec.Actor, rec.SourceIP)
+}
+
+// commitAuthor is the actor, in the form git wants an author in.
+func (rec *AuditRecord) commitAuthor() string {
+	return rec.Actor + " <" + rec.Actor + "@deploy>"
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceIP(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	var err error
+	if trustedProxies, err = parseTrustedProxies("10.0.0.1, 192.168.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ remoteAddr, forwardedFor, want string }{
+		{"1.2.3.4:5678", "", "1.2.3.4"},
+		{"1.2.3.4:5678", "6.6.6.6", "1.2.3.4"},
+		{"10.0.0.1:5678", "", "10.0.0.1"},
+		{"10.0.0.1:5678", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:5678", "6.6.6.6, 1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:5678", "6.6.6.6, 1.2.3.4, 192.168.1.1", "1.2.3.4"},
+		{"10.0.0.2:5678", "1.2.3.4", "10.0.0.2"},
+	} {
+		r := &http.Request{RemoteAddr: c.remoteAddr, Header: http.Header{}}
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if got := sourceIP(r); got != c.want {
+			t.Errorf("from %s, forwarded for %q: got %s, want %s", c.remoteAddr, c.forwardedFor, got, c.want)
+		}
+	}
+	for _, bad := range []string{"10.0.0", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("parsing %q: got no error", bad)
+		}
+	}
+}
+
+func TestChangesAreCommittedAsTheActor(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	_, repo := useTestRepo(t)
+
+	req, _ := http.NewRequest("PUT", s.URL+"/pools/p", strings.NewReader(`{"marathonHost": "`+f.URL+`"}`))
+	req.Header.Set(actorHeader, "alice")
+	req.Header.Set(requestIDHeader, "r1")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != 201 {
+		t.Fatalf("got %d, want 201", resp.StatusCode)
+	}
+	out, err := repo.git("log", "--format=%an%n%B%x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits := strings.Split(strings.Trim(out, "\x00\n"), "\x00")
+	if len(commits) != 2 {
+		t.Fatalf("got commits %q, want the change and its audit record", commits)
+	}
+	for _, c := range commits {
+		c = strings.TrimSpace(c)
+		if !strings.HasPrefix(c, "alice\n") || !strings.Contains(c, "\nRequest-Id: r1\nActor: alice\n") {
+			t.Errorf("got commit %q, want it by alice, with the request's trailers", c)
+		}
+	}
+	if !strings.Contains(commits[1], "Set pool p") {
+		t.Errorf("got first commit %q, want the change to the pool", commits[1])
+	}
+}
+
+func TestAuditedHoldsThePoolLock(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	api := newTestServer(t)
+	defer api.Close()
+	mustRequest(t, api, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, api, "PUT", "/pools/p/apps/web", `{"env": {"N": "0"}}`)
+	// Each request counts up N, relying on audited to lock the pool between
+	// reading and writing it.
+	s := httptest.NewServer(audited(func(w http.ResponseWriter, r *http.Request) {
+		a := state.GetApp("p", "web")
+		n, _ := strconv.Atoi(a.Env["N"])
+		time.Sleep(10 * time.Millisecond)
+		a.Env["N"] = strconv.Itoa(n + 1)
+		if err := state.SetApp("p", "web", a); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Close()
+	puts := []func(){}
+	for i := 0; i < 8; i++ {
+		puts = append(puts, func() { mustRequest(t, s, "PUT", "/pools/p/apps/web", "") })
+	}
+	parallel(puts...)
+	if n := state.GetApp("p", "web").Env["N"]; n != "8" {
+		t.Errorf("got N of %s, want 8", n)
+	}
+	// Each record's diff is of its own request's change alone.
+	changes := map[string]bool{}
+	for _, rec := range state.GetAudit() {
+		if change, ok := rec.Diff["env"]; ok && rec.Method == "PUT" {
+			changes[fmt.Sprint(change.Before, change.After)] = true
+		}
+	}
+	for i := 0; i < 8; i++ {
+		want := fmt.Sprint(map[string]interface{}{"N": strconv.Itoa(i)}, map[string]interface{}{"N": strconv.Itoa(i + 1)})
+		if !changes[want] {
+			t.Errorf("no record of the change %s", want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/opentable/hat"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Permission string
+
+// A key may be given each permission for a pool, or for every pool ("*").
+// Any permission for a pool includes reading it.
+const (
+	// CanRead is needed to GET anything.
+	CanRead = Permission("read")
+	// CanDeploy is needed to change apps and versions, and act on them, e.g.
+	// to roll back or scale.
+	CanDeploy = Permission("deploy")
+	// CanAdmin is needed to change the pool itself.
+	CanAdmin = Permission("admin")
+	// CanDelete is needed to delete the pool, or anything in it.
+	CanDelete = Permission("delete")
+)
+
+// allPools stands for every pool in a key's permissions. Anything that isn't
+// in a pool, e.g. the list of pools or the audit log, needs permission for
+// allPools.
+const allPools = "*"
+
+// Key is a secret that a client either sends as a bearer token, or signs its
+// requests with, and what it permits that client to do to each pool.
+type Key struct {
+	Secret string                  `json:"secret"`
+	Pools  map[string][]Permission `json:"pools"`
+}
+
+// Keys are by name; the name of the key that authenticated a request is its
+// actor in the audit log.
+type Keys map[string]*Key
+
+// hmacMaxSkew is how far the Date of a signed request may be from now.
+var hmacMaxSkew = 5 * time.Minute
+
+// loadKeys reads keys from a JSON file, e.g.:
+//
+//	{"ci": {"secret": "...", "pools": {"staging": ["deploy"], "*": ["read"]}}}
+func loadKeys(file string) (Keys, error) {
+	keys := Keys{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for name, k := range keys {
+		if k == nil || k.Secret == "" {
+			return nil, hat.Error("Key", name, "in", file, "has no secret.")
+		}
+	}
+	return keys, nil
+}
+
+// permits is true if the key has permission p for the pool.
+func (k *Key) permits(poolID string, p Permission) bool {
+	for _, id := range []string{poolID, allPools} {
+		for _, granted := range k.Pools[id] {
+			if granted == p || p == CanRead {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticated wraps handler so that only requests made with one of keys,
+// and permitted by it, get through. Others get 401 if the key isn't known,
+// or 403 if it doesn't permit the request.
+func authenticated(keys Keys, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, err := authenticate(keys, r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="deploy", HMAC realm="deploy"`)
+			hat.WriteError(w, err)
+			return
+		}
+		poolID, p := permissionFor(r)
+		if !keys[name].permits(poolID, p) {
+			if poolID == allPools {
+				poolID = "every pool"
+			}
+			hat.WriteError(w, hat.HttpError(403, "Key", name, "does not have", string(p), "permission for", poolID+"."))
+			return
+		}
+		r.Header.Set(actorHeader, name)
+		handler(w, r)
+	}
+}
+
+// authenticate returns the name of the key the request was made with, which
+// is sent as either:
+//
+//	Authorization: Bearer {secret}
+//	Authorization: HMAC {name}:{signature}
+//
+// where the signature is the base64 HMAC-SHA256, keyed with the secret, of
+// the request's method, path and query, Date header, and the hex SHA-256 of
+// its body, each followed by a newline.
+func authenticate(keys Keys, r *http.Request) (string, error) {
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 {
+		return "", hat.HttpError(401, "Authorization required; send a Bearer token or an HMAC signature.")
+	}
+	switch auth[0] {
+	case "Bearer":
+		for name, k := range keys {
+			if subtle.ConstantTimeCompare([]byte(auth[1]), []byte(k.Secret)) == 1 {
+				return name, nil
+			}
+		}
+		return "", hat.HttpError(401, "Bearer token not recognised.")
+	case "HMAC":
+		parts := strings.SplitN(auth[1], ":", 2)
+		k, ok := keys[parts[0]]
+		if len(parts) != 2 || !ok {
+			return "", hat.HttpError(401, "HMAC key not recognised; expected HMAC {name}:{signature}.")
+		}
+		if date, err := http.ParseTime(r.Header.Get("Date")); err != nil {
+			return "", hat.HttpError(401, "HMAC signed requests need a Date header:", err)
+		} else if skew := time.Since(date); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+			return "", hat.HttpError(401, "Date of HMAC signed request is more than", hmacMaxSkew, "from now.")
+		}
+		sig, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", hat.HttpError(401, "HMAC signature is not base64:", err)
+		}
+		if want, err := signature(k.Secret, r); err != nil {
+			return "", err
+		} else if !hmac.Equal(sig, want) {
+			return "", hat.HttpError(401, "HMAC signature does not match the request.")
+		}
+		return parts[0], nil
+	default:
+		return "", hat.HttpError(401, "Authorization scheme", auth[0], "not recognised; use Bearer or HMAC.")
+	}
+}
+
+// signature is the HMAC of the request, as described by authenticate. It
+// reads the body, and replaces it so that it can be read again.
+func signature(secret string, r *http.Request) ([]byte, error) {
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + r.Header.Get("Date") + "\n" + hex.EncodeToString(bodyHash[:]) + "\n"))
+	return mac.Sum(nil), nil
+}
+
+// permissionFor is the pool the request is to, or allPools, and the
+// permission it needs for it.
+func permissionFor(r *http.Request) (string, Permission) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "pools" {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			return allPools, CanRead
+		}
+		return allPools, CanAdmin
+	}
+	poolID, appID, _ := pathIDs(path)
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD":
+		return poolID, CanRead
+	case r.Method == "DELETE":
+		return poolID, CanDelete
+	case appID == "" && len(path) == 2:
+		return poolID, CanAdmin
+	default:
+		return poolID, CanDeploy
+	}
+}
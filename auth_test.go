@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKeys = Keys{
+	"ci":      {"ci-secret", map[string][]Permission{"staging": {CanDeploy}, allPools: {CanRead}}},
+	"ops":     {"ops-secret", map[string][]Permission{allPools: {CanRead, CanDeploy, CanAdmin, CanDelete}}},
+	"staging": {"staging-secret", map[string][]Permission{"staging": {CanRead, CanAdmin, CanDelete}}},
+}
+
+// authRequest makes a request through authenticated with testKeys, and
+// returns the status and the actor the request got through as, if it did.
+func authRequest(method, path, body string, header http.Header) (int, string) {
+	actor := ""
+	h := authenticated(testKeys, func(w http.ResponseWriter, r *http.Request) {
+		actor = r.Header.Get(actorHeader)
+		w.WriteHeader(200)
+	})
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Code, actor
+}
+
+// signed is the headers of a request signed at date with the named key in
+// testKeys, or with some other secret if there is no such key.
+func signed(t *testing.T, key, method, path, body string, date time.Time) http.Header {
+	secret := "unknown"
+	if k, ok := testKeys[key]; ok {
+		secret = k.Secret
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	sig, err := signature(secret, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "HMAC "+key+":"+base64.StdEncoding.EncodeToString(sig))
+	return r.Header
+}
+
+func bearer(secret string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + secret}}
+}
+
+func TestAuthenticate(t *testing.T) {
+	body := `{"env": {"A": "1"}}`
+	tampered := signed(t, "ci", "PUT", "/pools/staging/apps/web", body, time.Now())
+	for _, c := range []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		header    http.Header
+		want      int
+		wantActor string
+	}{
+		{"bearer", "GET", "/pools", "", bearer("ci-secret"), 200, "ci"},
+		{"unknown bearer", "GET", "/pools", "", bearer("nope"), 401, ""},
+		{"no authorization", "GET", "/pools", "", http.Header{}, 401, ""},
+		{"unknown scheme", "GET", "/pools", "", http.Header{"Authorization": {"Basic Y2k6Y2k="}}, 401, ""},
+		{"hmac", "PUT", "/pools/staging/apps/web", body, signed(t, "ci", "PUT", "/pools/staging/apps/web", body, time.Now()), 200, "ci"},
+		{"hmac with query", "GET", "/pools?page=2", "", signed(t, "ci", "GET", "/pools?page=2", "", time.Now()), 200, "ci"},
+		{"hmac unknown key", "GET", "/pools", "", signed(t, "nobody", "GET", "/pools", "", time.Now()), 401, ""},
+		{"hmac bad signature", "GET", "/pools", "", http.Header{"Authorization": {"HMAC ci:" + base64.StdEncoding.EncodeToString([]byte("nope"))},
+			"Date": {time.Now().UTC().Format(http.TimeFormat)}}, 401, ""},
+		{"hmac signature not base64", "GET", "/pools", "", http.Header{"Authorization": {"HMAC ci:!"},
+			"Date": {time.Now().UTC().Format(http.TimeFormat)}}, 401, ""},
+		{"hmac signed for another path", "GET", "/pools/prod", "", signed(t, "ci", "GET", "/pools/staging", "", time.Now()), 401, ""},
+		{"hmac body changed", "PUT", "/pools/staging/apps/web", `{"env": {"A": "2"}}`, tampered, 401, ""},
+		{"hmac without date", "GET", "/pools", "", http.Header{"Authorization": signed(t, "ci", "GET", "/pools", "", time.Now())["Authorization"]}, 401, ""},
+		{"hmac date too old", "GET", "/pools", "", signed(t, "ci", "GET", "/pools", "", time.Now().Add(-6*time.Minute)), 401, ""},
+		{"hmac date too new", "GET", "/pools", "", signed(t, "ci", "GET", "/pools", "", time.Now().Add(6*time.Minute)), 401, ""},
+		{"hmac date within skew", "GET", "/pools", "", signed(t, "ci", "GET", "/pools", "", time.Now().Add(-4*time.Minute)), 200, "ci"},
+	} {
+		status, actor := authRequest(c.method, c.path, c.body, c.header)
+		if status != c.want || actor != c.wantActor {
+			t.Errorf("%s: got %d as %q, want %d as %q", c.name, status, actor, c.want, c.wantActor)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	for _, c := range []struct {
+		key, method, path string
+		want              int
+	}{
+		// ci can read everything, but only deploy to staging.
+		{"ci", "GET", "/pools", 200},
+		{"ci", "GET", "/pools/prod/apps/web", 200},
+		{"ci", "GET", "/audit", 200},
+		{"ci", "PUT", "/pools/staging/apps/web", 200},
+		{"ci", "PATCH", "/pools/staging/apps/web", 200},
+		{"ci", "PUT", "/pools/staging/apps/web/versions/2", 200},
+		{"ci", "POST", "/pools/staging/apps/web/rollback", 200},
+		{"ci", "POST", "/pools/staging/apps/web/versions/2/scale", 200},
+		{"ci", "PUT", "/pools/prod/apps/web", 403},
+		{"ci", "PUT", "/pools/staging", 403},
+		{"ci", "PATCH", "/pools/staging", 403},
+		{"ci", "DELETE", "/pools/staging/apps/web/versions/2", 403},
+		{"ci", "DELETE", "/pools/staging", 403},
+		// staging can read, change and delete staging, but not deploy to it,
+		// and nothing else.
+		{"staging", "GET", "/pools/staging", 200},
+		{"staging", "GET", "/pools/staging/apps/web/history", 200},
+		{"staging", "PUT", "/pools/staging", 200},
+		{"staging", "DELETE", "/pools/staging", 200},
+		{"staging", "DELETE", "/pools/staging/apps/web", 200},
+		{"staging", "PUT", "/pools/staging/apps/web", 403},
+		{"staging", "GET", "/pools/prod", 403},
+		{"staging", "PUT", "/pools/prod", 403},
+		{"staging", "GET", "/pools", 403},
+		{"staging", "GET", "/audit", 403},
+		// ops can do anything anywhere.
+		{"ops", "PUT", "/pools/prod", 200},
+		{"ops", "PUT", "/pools/prod/apps/web/versions/2", 200},
+		{"ops", "DELETE", "/pools/prod", 200},
+		{"ops", "GET", "/audit", 200},
+	} {
+		if status, _ := authRequest(c.method, c.path, "", bearer(testKeys[c.key].Secret)); status != c.want {
+			t.Errorf("%s %s with %s: got %d, want %d", c.method, c.path, c.key, status, c.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often to sample the metrics of autoscaled apps.
+var autoscaleInterval = 30 * time.Second
+
+// Autoscale scales a version between MinInstances and MaxInstances, so that
+// the average of the number at MetricURI across its instances is near
+// Target. It leaves the version alone while the average is within Tolerance
+// (a fraction, e.g. 0.1) of Target, and for Cooldown, e.g. "3m", after
+// scaling it.
+type Autoscale struct {
+	MetricURI string  `json:"metricUri"`
+	Target    float64 `json:"target"`
+	Tolerance float64 `json:"tolerance,omitempty"`
+	Cooldown  string  `json:"cooldown,omitempty"`
+}
+
+var (
+	defaultTolerance = 0.1
+	defaultCooldown  = 3 * time.Minute
+)
+
+func (a *Autoscale) tolerance() float64 {
+	if a.Tolerance == 0 {
+		return defaultTolerance
+	}
+	return a.Tolerance
+}
+
+// cooldown is Cooldown, or the default if there isn't one. Cooldown is
+// checked when the version is validated.
+func (a *Autoscale) cooldown() time.Duration {
+	if d, err := time.ParseDuration(a.Cooldown); err == nil {
+		return d
+	}
+	return defaultCooldown
+}
+
+// Scaling is what the autoscaler last saw and did to a version.
+type Scaling struct {
+	Current  int       `json:"current"`
+	Target   int       `json:"target"`
+	Decision string    `json:"decision,omitempty"`
+	At       time.Time `json:"at,omitempty"`
+}
+
+// autoscaleEvery autoscales every app that wants it, forever.
+func autoscaleEvery(interval time.Duration) {
+	for {
+		autoscale()
+		time.Sleep(interval)
+	}
+}
+
+func autoscale() {
+	for _, poolID := range state.GetPoolIDs() {
+		autoscalePool(poolID)
+	}
+}
+
+// autoscalePool autoscales the current version of each app in the pool, once
+// it is healthy.
+func autoscalePool(poolID string) {
+	pool := state.GetPool(poolID)
+	if pool == nil {
+		return
+	}
+	m := newMarathon(pool.MarathonHost)
+	for appID, app := range *pool.Apps {
+		versionID, v := app.current()
+		if v == nil || v.Autoscale == nil || v.Deployment.Status != Healthy {
+			continue
+		}
+		if err := autoscaleVersion(m, poolID, appID, versionID, v); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// autoscaleVersion samples the version's metric, and scales it if need be.
+// The metric is sampled before the pool is locked, so that slow instances
+// don't hold up changes to the pool; the version is left alone if it has
+// changed by the time the pool is locked, e.g. because it was scaled by hand.
+func autoscaleVersion(m *marathon, poolID, appID, versionID string, v *Version) error {
+	app, err := m.GetApp(v.Deployment.appID(appID))
+	if err != nil {
+		return err
+	}
+	average, sampled, err := sampleMetrics(app.Tasks, v.Autoscale.MetricURI)
+	if err != nil {
+		return err
+	}
+	defer state.LockPool(poolID)()
+	d := v.Deployment
+	if a := state.GetApp(poolID, appID); a == nil {
+		return nil
+	} else if currentID, current := a.current(); currentID != versionID || current.Autoscale == nil ||
+		current.Deployment.Event != d.Event || current.Deployment.Status != Healthy ||
+		!reflect.DeepEqual(current.Deployment.Scaling, d.Scaling) {
+		return nil
+	}
+	old := Scaling{}
+	if d.Scaling != nil {
+		old = *d.Scaling
+	}
+	s := old
+	s.Current = app.Instances
+	s.Target = app.Instances
+	if sampled {
+		s.Target = targetInstances(v, app.Instances, average)
+		if s.Target != s.Current && time.Since(s.At) > v.Autoscale.cooldown() {
+			if _, err := m.Scale(d.appID(appID), s.Target); err != nil {
+				return err
+			}
+			s.Decision = fmt.Sprintf("scaled from %d to %d instances; average %s was %g, target %g",
+				s.Current, s.Target, v.Autoscale.MetricURI, average, v.Autoscale.Target)
+			s.At = time.Now().UTC()
+		}
+	}
+	if s == old {
+		return nil
+	}
+	d.Scaling = &s
+	return state.SetDeployment(poolID, appID, versionID, d)
+}
+
+// targetInstances is how many instances would bring the average metric to
+// its target, within the version's bounds.
+func targetInstances(v *Version, current int, average float64) int {
+	a := v.Autoscale
+	ratio := average / a.Target
+	if math.Abs(ratio-1) <= a.tolerance() {
+		return current
+	}
+	target := int(math.Ceil(float64(current) * ratio))
+	if target < v.MinInstances {
+		target = v.MinInstances
+	}
+	if target > v.MaxInstances {
+		target = v.MaxInstances
+	}
+	return target
+}
+
+// sampleMetrics samples the metric of every task at once, and returns their
+// average, or false if there are no tasks to sample.
+func sampleMetrics(tasks []marathonTask, uri string) (float64, bool, error) {
+	if len(tasks) == 0 {
+		return 0, false, nil
+	}
+	samples := make([]float64, len(tasks))
+	err := forEachTask(tasks, func(i int, t marathonTask) error {
+		var err error
+		samples[i], err = sampleMetric(t, uri)
+		return err
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	total := 0.0
+	for _, sample := range samples {
+		total += sample
+	}
+	return total / float64(len(samples)), true, nil
+}
+
+// sampleMetric GETs the metric URI of a Marathon task, on its first port,
+// which should respond with just a number.
+func sampleMetric(t marathonTask, uri string) (float64, error) {
+	addr, ok := t.addr()
+	if !ok {
+		return 0, fmt.Errorf("task on %s has no ports to sample %s on", t.Host, uri)
+	}
+	resp, err := taskClient.Get("http://" + addr + uri)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("sampling %s%s: %s", addr, uri, resp.Status)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
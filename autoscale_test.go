@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoscaleSamplesWithoutLockingPool(t *testing.T) {
+	sampling, release := make(chan bool, 8), make(chan bool)
+	tasks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sampling <- true
+		<-release
+		w.Write([]byte("100"))
+	}))
+	defer tasks.Close()
+	f := newFakeMarathon()
+	defer f.Close()
+	f.taskAddr = strings.TrimPrefix(tasks.URL, "http://")
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1",
+		`{"command": ["./web"], "minInstances": 2, "maxInstances": 4, "requirements": {"Ports": 1},
+		  "autoscale": {"metricUri": "/load", "target": 50}}`)
+	reconcilePoolDeployments("p")
+
+	done := make(chan bool)
+	go func() {
+		autoscalePool("p")
+		done <- true
+	}()
+	<-sampling
+	locked := make(chan bool)
+	go func() {
+		defer state.LockPool("p")()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the pool was locked while its metrics were sampled")
+	}
+	close(release)
+	<-done
+	if a := f.app("/web"); a.Instances != 4 {
+		t.Errorf("got %d instances, want 4", a.Instances)
+	}
+	if d := state.GetVersion("p", "web", "1").Deployment; d.Scaling == nil || d.Scaling.Target != 4 {
+		t.Errorf("got scaling %+v, want a target of 4", d.Scaling)
+	}
+}
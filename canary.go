@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultBakeTime is how long a canary runs, if its strategy doesn't say.
+var defaultBakeTime = 5 * time.Minute
+
+// Bake is the progress of a canary deployment. The canary runs alongside
+// the version it is to replace until Until, then is either promoted to
+// take over from it, or removed.
+type Bake struct {
+	From              string    `json:"from"`
+	FromMarathonAppID string    `json:"fromMarathonAppId"`
+	Instances         int       `json:"instances"`
+	Until             time.Time `json:"bakeUntil,omitempty"`
+	Promoting         bool      `json:"promoting"`
+	Decision          string    `json:"decision,omitempty"`
+	StepStarted       time.Time `json:"stepStarted"`
+}
+
+// bakeTime is BakeTime, or the default if there isn't one. BakeTime is
+// checked when the version is validated.
+func (s Strategy) bakeTime() time.Duration {
+	if d, err := time.ParseDuration(s.BakeTime); err == nil {
+		return d
+	}
+	return defaultBakeTime
+}
+
+func (s Strategy) canaryInstances() int {
+	if s.CanaryInstances == 0 {
+		return 1
+	}
+	return s.CanaryInstances
+}
+
+// baking is true for a canary that has not yet been promoted or removed.
+func (d *Deployment) baking() bool {
+	return d.Bake != nil && !d.Settled()
+}
+
+// startCanary records in d that the version it deploys is running a few
+// instances in a Marathon app of its own, to bake alongside the from
+// version, which runs in fromApp.
+func startCanary(d *Deployment, from string, fromApp *marathonApp, instances int) {
+	d.Bake = &Bake{from, fromApp.ID, instances, time.Time{}, false, "", time.Now().UTC()}
+}
+
+// checkCanaries checks the health of every instance of each canary in the
+// pool that is baking. It is called before the pool is locked, so that slow
+// instances don't hold up changes to the pool. The results are keyed by app
+// and version ID, e.g. "web/2"; a nil result means every instance was
+// healthy.
+func checkCanaries(poolID string) map[string]error {
+	health := map[string]error{}
+	pool := state.GetPool(poolID)
+	if pool == nil {
+		return health
+	}
+	m := newMarathon(pool.MarathonHost)
+	for appID, app := range *pool.Apps {
+		for versionID, v := range *app.Versions {
+			d := v.Deployment
+			if d == nil || !d.baking() || d.Bake.Promoting || d.Bake.Until.IsZero() || v.HealthURI == "" {
+				continue
+			}
+			canary, err := m.GetApp(d.MarathonAppID)
+			if err != nil {
+				// reconcileCanary will find this out for itself.
+				continue
+			}
+			health[appID+"/"+versionID] = forEachTask(canary.Tasks, func(_ int, t marathonTask) error {
+				return checkHealth(t, v.HealthURI)
+			})
+		}
+	}
+	return health
+}
+
+// reconcileCanary waits for the canary to be up, then checks the health of
+// each of its instances every time it is called until the bake time is up.
+// If they stay healthy, the canary is scaled up to replace the from version,
+// which is then removed; otherwise the canary is removed. The health of the
+// instances is as found by checkCanaries; while there is none, it waits. It
+// returns true if d changed. The caller must hold the pool's lock.
+func reconcileCanary(m *marathon, poolID, appID, versionID string, v *Version, running map[string]bool, health map[string]error) (bool, error) {
+	d, c := v.Deployment, v.Deployment.Bake
+	timedOut := time.Since(c.StepStarted) > deploymentTimeout
+	if running[d.MarathonID] {
+		if timedOut {
+			return failCanary(m, d, "not up after "+deploymentTimeout.String())
+		}
+		return false, nil
+	}
+	app, err := m.GetApp(d.MarathonAppID)
+	if err == errMarathonNotFound {
+		return failCanary(m, d, "app no longer exists in Marathon")
+	} else if err != nil {
+		return false, err
+	}
+	want := c.Instances
+	if c.Promoting {
+		want = v.MinInstances
+	}
+	if app.ready() < want {
+		if timedOut {
+			return failCanary(m, d, "not healthy after "+deploymentTimeout.String())
+		}
+		return false, nil
+	}
+	if c.Promoting {
+		if err := m.Delete(c.FromMarathonAppID); err != nil {
+			return false, err
+		}
+		if from := state.GetVersion(poolID, appID, c.From); from != nil && from.Deployment != nil {
+			if from.Deployment.transition(Superseded, "canary "+versionID+" was promoted") {
+				if err := state.SetDeployment(poolID, appID, c.From, from.Deployment); err != nil {
+					return false, err
+				}
+			}
+		}
+		return d.transition(Healthy, c.Decision), nil
+	}
+	if c.Until.IsZero() {
+		c.Until = time.Now().UTC().Add(v.Strategy.bakeTime())
+		d.Reason = "baking until " + c.Until.Format(time.RFC3339)
+		return true, nil
+	}
+	if v.HealthURI != "" {
+		if err, checked := health[appID+"/"+versionID]; !checked {
+			return false, nil
+		} else if err != nil {
+			return failCanary(m, d, err.Error())
+		}
+	}
+	if time.Now().Before(c.Until) {
+		return false, nil
+	}
+	if d.MarathonID, err = m.Scale(d.MarathonAppID, v.MinInstances); err != nil {
+		return false, err
+	}
+	c.Promoting = true
+	c.StepStarted = time.Now().UTC()
+	c.Decision = "promoted: healthy throughout " + v.Strategy.bakeTime().String() + " bake"
+	d.Reason = fmt.Sprintf("scaling up to %d instances", v.MinInstances)
+	return true, nil
+}
+
+// failCanary removes the canary, leaving the from version running as it was.
+func failCanary(m *marathon, d *Deployment, why string) (bool, error) {
+	if err := m.Delete(d.MarathonAppID); err != nil {
+		return false, err
+	}
+	d.Bake.Decision = "removed: " + why
+	return d.transition(Failed, d.Bake.Decision), nil
+}
+
+// taskTimeout is how long an instance has to answer a health check or a
+// metric sample. It is short, since instances are checked every few seconds.
+var taskTimeout = 2 * time.Second
+
+// taskClient is for talking to the instances of apps directly.
+var taskClient = &http.Client{Timeout: taskTimeout}
+
+// forEachTask calls f for each of tasks at once, and returns the first error
+// any of them returned.
+func forEachTask(tasks []marathonTask, f func(i int, t marathonTask) error) error {
+	errs := make(chan error, len(tasks))
+	for i, t := range tasks {
+		go func(i int, t marathonTask) {
+			errs <- f(i, t)
+		}(i, t)
+	}
+	var first error
+	for _ = range tasks {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// checkHealth GETs the health URI of a Marathon task, on its first port.
+func checkHealth(t marathonTask, uri string) error {
+	addr, ok := t.addr()
+	if !ok {
+		return nil
+	}
+	resp, err := taskClient.Get("http://" + addr + uri)
+	if err != nil {
+		return fmt.Errorf("health check of %s failed: %s", addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check of %s failed: %s", addr, resp.Status)
+	}
+	return nil
+}
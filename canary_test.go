@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startCanaryTest deploys version 1 of an app, and once it is healthy, starts
+// version 2 as a canary beside it. The instances of both answer health
+// checks with health.
+func startCanaryTest(t *testing.T, health int, stuck bool) (*fakeMarathon, func()) {
+	tasks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(health)
+	}))
+	f := newFakeMarathon()
+	f.taskAddr = strings.TrimPrefix(tasks.URL, "http://")
+	s := newTestServer(t)
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1",
+		`{"command": ["./web"], "minInstances": 3, "healthUri": "/health", "requirements": {"Ports": 1}}`)
+	reconcilePoolDeployments("p")
+	f.stuck = stuck
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2",
+		`{"command": ["./web"], "minInstances": 3, "healthUri": "/health", "requirements": {"Ports": 1},
+		  "strategy": {"type": "canary", "canaryInstances": 1, "bakeTime": "0s"}}`)
+	return f, func() {
+		s.Close()
+		f.Close()
+		tasks.Close()
+	}
+}
+
+func TestCanaryBakesThenPromotes(t *testing.T) {
+	f, done := startCanaryTest(t, 200, false)
+	defer done()
+	if c := f.app("/web-2"); c == nil || c.Instances != 1 {
+		t.Fatalf("got canary %+v, want 1 instance", c)
+	}
+	// Once it's up the canary bakes, then is scaled up, then replaces 1.
+	for i := 0; i < 3; i++ {
+		reconcilePoolDeployments("p")
+	}
+	d := state.GetVersion("p", "web", "2").Deployment
+	if d.Status != Healthy || !strings.HasPrefix(d.Bake.Decision, "promoted") {
+		t.Errorf("got %s, %q; want healthy, promoted", d.Status, d.Bake.Decision)
+	}
+	if c := f.app("/web-2"); c == nil || c.Instances != 3 {
+		t.Errorf("got canary %+v, want 3 instances", c)
+	}
+	if f.app("/web") != nil {
+		t.Error("version 1 is still in Marathon")
+	}
+	if d := state.GetVersion("p", "web", "1").Deployment; d.Status != Superseded {
+		t.Errorf("version 1 is %s, want superseded", d.Status)
+	}
+	if liveID, _ := state.GetApp("p", "web").current(); liveID != "2" {
+		t.Errorf("live version is %q, want 2", liveID)
+	}
+}
+
+func TestCanaryFailingHealthCheckIsRemoved(t *testing.T) {
+	f, done := startCanaryTest(t, 500, false)
+	defer done()
+	for i := 0; i < 2; i++ {
+		reconcilePoolDeployments("p")
+	}
+	d := state.GetVersion("p", "web", "2").Deployment
+	if d.Status != Failed || !strings.Contains(d.Bake.Decision, "500") {
+		t.Errorf("got %s, %q; want failed by the health check", d.Status, d.Bake.Decision)
+	}
+	if f.app("/web-2") != nil {
+		t.Error("the canary is still in Marathon")
+	}
+	if a := f.app("/web"); a == nil || a.Instances != 3 || a.Labels["version"] != "1" {
+		t.Errorf("got %+v, want version 1 untouched", a)
+	}
+	if liveID, _ := state.GetApp("p", "web").current(); liveID != "1" {
+		t.Errorf("live version is %q, want 1", liveID)
+	}
+}
+
+func TestCanaryTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { deploymentTimeout = timeout }(deploymentTimeout)
+	f, done := startCanaryTest(t, 200, true)
+	defer done()
+	reconcilePoolDeployments("p")
+	if d := state.GetVersion("p", "web", "2").Deployment; d.Status != Deploying {
+		t.Fatalf("got %s before the timeout, want deploying", d.Status)
+	}
+	deploymentTimeout = 0
+	reconcilePoolDeployments("p")
+	d := state.GetVersion("p", "web", "2").Deployment
+	if d.Status != Failed || !strings.Contains(d.Bake.Decision, "not up after") {
+		t.Errorf("got %s, %q; want failed by the timeout", d.Status, d.Bake.Decision)
+	}
+	if f.app("/web-2") != nil {
+		t.Error("the canary is still in Marathon")
+	}
+	if liveID, _ := state.GetApp("p", "web").current(); liveID != "1" {
+		t.Errorf("live version is %q, want 1", liveID)
+	}
+}
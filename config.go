@@ -0,0 +1,178 @@
+package main
+
+import (
+	"github.com/opentable/hat"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// How often to pull the config repo for changes to pools.
+var configSyncInterval = time.Minute
+
+// Pools made through the API have Source sourceAPI; pools declared in the
+// config repo have sourceConfig followed by the file they are declared in,
+// and can only be changed there.
+const (
+	sourceAPI    = "api"
+	sourceConfig = "config:"
+)
+
+// The config repo declares pools, and the environments they are in:
+//
+//	environments/{environment}.json
+//	pools/{pool}.json
+//
+// An environment gives the Marathon host, env, policy and drift mode of its
+// pools by default. A pool names its environment, and may give its own
+// Marathon host, policy or drift mode instead, or env vars to add to the
+// environment's.
+type Environment struct {
+	MarathonHost string            `json:"marathonHost"`
+	Env          map[string]string `json:"env"`
+	Policy       Policy            `json:"policy"`
+	DriftMode    DriftMode         `json:"driftMode"`
+}
+
+type PoolTemplate struct {
+	Environment  string            `json:"environment"`
+	MarathonHost string            `json:"marathonHost"`
+	Env          map[string]string `json:"env"`
+	Policy       *Policy           `json:"policy"`
+	DriftMode    *DriftMode        `json:"driftMode"`
+}
+
+func environmentFile(environment string) string {
+	return path.Join("environments", environment+".json")
+}
+
+func poolTemplateFile(pool string) string {
+	return path.Join("pools", pool+".json")
+}
+
+// writable returns an error if the pool is declared in the config repo.
+func (p *Pool) writable(name string) error {
+	if p != nil && strings.HasPrefix(p.Source, sourceConfig) {
+		return hat.HttpError(403, "Pool", name, "is read-only; it is declared in the config repo at",
+			strings.TrimPrefix(p.Source, sourceConfig)+", so change it there.")
+	}
+	return nil
+}
+
+// syncConfigEvery pulls the config repo and applies its pools, forever.
+func syncConfigEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := gitConfig.Pull(); err != nil {
+			log.Error(err)
+			continue
+		}
+		syncConfig()
+	}
+}
+
+// syncConfig makes the pools in state match those declared in the config
+// repo. Pools that are no longer declared are deleted, unless they still
+// have running apps. Problems with one pool, or its file, are logged, and
+// don't stop the others being synced.
+func syncConfig() {
+	pools, err := loadPoolTemplates(gitConfig)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for name, p := range pools {
+		if p == nil {
+			continue
+		}
+		if err := syncPool(name, p); err != nil {
+			log.Error("Unable to sync pool " + name + " from config: " + err.Error())
+		}
+	}
+	for _, name := range state.GetPoolIDs() {
+		if _, declared := pools[name]; !declared {
+			if err := unsyncPool(name); err != nil {
+				log.Error("Unable to delete pool " + name + ", which is no longer in config: " + err.Error())
+			}
+		}
+	}
+}
+
+// loadPoolTemplates reads every pool declared in the config repo, and turns
+// it into the pool it declares. A pool whose file, or environment's file,
+// can't be read is logged, and left nil, so that it is neither changed nor
+// deleted until it is fixed.
+func loadPoolTemplates(repo *gitRepo) (map[string]*Pool, error) {
+	repo.Lock()
+	defer repo.Unlock()
+	files, err := repo.Glob(poolTemplateFile("*"))
+	if err != nil {
+		return nil, err
+	}
+	pools := map[string]*Pool{}
+	for _, f := range files {
+		name := strings.TrimSuffix(path.Base(f), ".json")
+		if pools[name], err = loadPoolTemplate(repo, name, f); err != nil {
+			log.Error("Unable to load pool " + name + " from config: " + err.Error())
+		}
+	}
+	return pools, nil
+}
+
+// loadPoolTemplate reads the pool declared in f. The caller must hold the
+// repo's lock.
+func loadPoolTemplate(repo *gitRepo, name, f string) (*Pool, error) {
+	t := &PoolTemplate{}
+	if err := repo.ReadJSON(f, t); err != nil {
+		return nil, hat.Error(f+":", err)
+	}
+	e := &Environment{}
+	if t.Environment != "" {
+		if err := repo.ReadJSON(environmentFile(t.Environment), e); err != nil {
+			return nil, hat.Error(environmentFile(t.Environment)+":", err)
+		}
+	}
+	p := &Pool{Name: name, MarathonHost: e.MarathonHost, Env: effectiveEnv(e.Env, t.Env), Policy: e.Policy, DriftMode: e.DriftMode, Source: sourceConfig + f}
+	if t.MarathonHost != "" {
+		p.MarathonHost = t.MarathonHost
+	}
+	if t.Policy != nil {
+		p.Policy = *t.Policy
+	}
+	if t.DriftMode != nil {
+		p.DriftMode = *t.DriftMode
+	}
+	return p, nil
+}
+
+// syncPool writes a pool from config, if it has changed. It won't replace a
+// pool made through the API.
+func syncPool(name string, p *Pool) error {
+	if err := p.Validate(nil, name); err != nil {
+		return err
+	}
+	defer state.LockPool(name)()
+	old := state.GetPool(name)
+	if old != nil {
+		if !strings.HasPrefix(old.Source, sourceConfig) {
+			return hat.Error("a pool of that name was made through the API")
+		}
+		if old.MarathonHost == p.MarathonHost && reflect.DeepEqual(old.Env, p.Env) &&
+			reflect.DeepEqual(old.Policy, p.Policy) && old.DriftMode == p.DriftMode && old.Source == p.Source {
+			return nil
+		}
+	}
+	return writePool(name, p, old, systemActor)
+}
+
+// unsyncPool deletes a pool that came from config but no longer appears
+// there.
+func unsyncPool(name string) error {
+	defer state.LockPool(name)()
+	pool := state.GetPool(name)
+	if pool == nil || !strings.HasPrefix(pool.Source, sourceConfig) {
+		return nil
+	}
+	return deletePool(name, pool, false)
+}
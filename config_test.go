@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// useTestConfig uses a config repo, with no remote, that has files, by
+// path. It returns a function to change the files in it; "" removes one.
+func useTestConfig(t *testing.T, files map[string]string) func(map[string]string) {
+	g := &gitRepo{Dir: t.TempDir()}
+	write := func(files map[string]string) {
+		for f, content := range files {
+			p := g.path(f)
+			if content == "" {
+				os.Remove(p)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(files)
+	old := gitConfig
+	gitConfig = g
+	t.Cleanup(func() { gitConfig = old })
+	return write
+}
+
+func TestSyncConfig(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/mine", `{"marathonHost": "`+f.URL+`"}`)
+	write := useTestConfig(t, map[string]string{
+		"environments/staging.json": `{"marathonHost": "` + f.URL + `", "env": {"ENV": "staging"}, "driftMode": "correct"}`,
+		"pools/a.json":              `{"environment": "staging", "env": {"POOL": "a"}}`,
+		"pools/b.json":              `{"environment": "staging", "driftMode": ""}`,
+		"pools/broken.json":         `{"environment": `,
+		"pools/lost.json":           `{"environment": "production"}`,
+		"pools/mine.json":           `{"environment": "staging"}`,
+	})
+	syncConfig()
+	if ids := state.GetPoolIDs(); !reflect.DeepEqual(ids, []string{"a", "b", "mine"}) {
+		t.Fatalf("got pools %v, want a, b and mine", ids)
+	}
+	a, b := state.GetPool("a"), state.GetPool("b")
+	if a.Source != "config:pools/a.json" || a.MarathonHost != f.URL || a.DriftMode != DriftCorrect ||
+		!reflect.DeepEqual(a.Env, map[string]string{"ENV": "staging", "POOL": "a"}) {
+		t.Errorf("got pool a %+v", a)
+	}
+	if b.DriftMode != DriftReport {
+		t.Errorf("got pool b's drift mode %q, want its own", b.DriftMode)
+	}
+	if mine := state.GetPool("mine"); mine.Source != sourceAPI {
+		t.Errorf("the pool made through the API was replaced by %+v", mine)
+	}
+
+	// Changing a file updates its pool; breaking one leaves its pool alone.
+	write(map[string]string{
+		"pools/a.json":    `{"environment": "staging", "env": {"POOL": "a2"}}`,
+		"pools/b.json":    `{"environment": "production"}`,
+		"pools/lost.json": `{"environment": "staging"}`,
+	})
+	syncConfig()
+	if env := state.GetPool("a").Env; env["POOL"] != "a2" {
+		t.Errorf("got pool a's env %v, want POOL=a2", env)
+	}
+	if got := state.GetPool("b"); got == nil || !reflect.DeepEqual(got, b) {
+		t.Errorf("got pool b %+v, want it unchanged while its file is broken", got)
+	}
+	if state.GetPool("lost") == nil {
+		t.Error("pool lost wasn't created once its environment was fixed")
+	}
+
+	// A pool removed from config is deleted only once it has nothing running.
+	mustRequest(t, s, "PUT", "/pools/a/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/a/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	write(map[string]string{"pools/a.json": "", "pools/lost.json": ""})
+	syncConfig()
+	if state.GetPool("a") == nil {
+		t.Fatal("pool a was deleted with an app running")
+	}
+	if state.GetPool("lost") != nil {
+		t.Error("pool lost wasn't deleted")
+	}
+	mustRequest(t, s, "DELETE", "/pools/a/apps/web", "")
+	syncConfig()
+	if state.GetPool("a") != nil {
+		t.Error("pool a wasn't deleted once it had nothing running")
+	}
+	if state.GetPool("b") == nil || state.GetPool("mine") == nil {
+		t.Error("pool b or mine was deleted")
+	}
+}
+
+func TestConfigPoolsAreReadOnly(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	useTestConfig(t, map[string]string{"pools/a.json": `{"marathonHost": "` + f.URL + `"}`})
+	syncConfig()
+	for _, r := range []struct{ method, path, body string }{
+		{"PUT", "/pools/a", `{"marathonHost": "` + f.URL + `", "env": {"A": "1"}}`},
+		{"PATCH", "/pools/a", `{"env": {"A": "1"}}`},
+		{"DELETE", "/pools/a", ""},
+		{"DELETE", "/pools/a?force=true", ""},
+	} {
+		if status, body := request(t, s, r.method, r.path, r.body); status != 403 {
+			t.Errorf("%s %s: got %d %s, want 403", r.method, r.path, status, body)
+		}
+	}
+	if p := state.GetPool("a"); p == nil || len(p.Env) != 0 {
+		t.Errorf("got pool a %+v, want it unchanged", p)
+	}
+	mustRequest(t, s, "PUT", "/pools/a/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/a/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	if f.app("/web") == nil {
+		t.Error("the app wasn't deployed")
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opentable/hat"
+	"sort"
+	"time"
+)
+
+type DeploymentStatus string
+
+const (
+	Pending    = DeploymentStatus("pending")
+	Deploying  = DeploymentStatus("deploying")
+	Healthy    = DeploymentStatus("healthy")
+	Failed     = DeploymentStatus("failed")
+	Superseded = DeploymentStatus("superseded")
+)
+
+// Deployment tracks a version from the moment it is PUT until it is running
+// healthily in Marathon, or has failed, or has been replaced.
+type Deployment struct {
+	Status        DeploymentStatus `json:"status"`
+	Reason        string           `json:"reason,omitempty"`
+	MarathonAppID string           `json:"marathonAppId,omitempty"`
+	MarathonID    string           `json:"marathonDeploymentId,omitempty"`
+	Rollout       *Rollout         `json:"rollout,omitempty"`
+	Cutover       *Cutover         `json:"cutover,omitempty"`
+	Bake          *Bake            `json:"canary,omitempty"`
+	Scaling       *Scaling         `json:"scaling,omitempty"`
+	Transitions   []Transition     `json:"transitions"`
+	// Event is the ID of the event in the app's history that started the
+	// deployment.
+	Event string `json:"event,omitempty"`
+}
+
+type Transition struct {
+	Status DeploymentStatus `json:"status"`
+	Reason string           `json:"reason,omitempty"`
+	At     time.Time        `json:"at"`
+}
+
+// deploymentTimeout is how long a deployment may take to become healthy
+// before it is considered failed.
+var deploymentTimeout = 10 * time.Minute
+
+func newDeployment() *Deployment {
+	d := &Deployment{}
+	d.transition(Pending, "")
+	return d
+}
+
+// transition moves the deployment to status, returning false if it was
+// already there.
+func (d *Deployment) transition(status DeploymentStatus, reason string) bool {
+	if d.Status == status {
+		return false
+	}
+	d.Status = status
+	d.Reason = reason
+	d.Transitions = append(d.Transitions, Transition{status, reason, time.Now().UTC()})
+	return true
+}
+
+func (d *Deployment) Started() time.Time {
+	return d.Transitions[0].At
+}
+
+// appID is the ID of the Marathon app the deployment is in. Deployments
+// made before versions could have Marathon apps of their own don't say.
+func (d *Deployment) appID(app string) string {
+	if d.MarathonAppID == "" {
+		return marathonAppID(app)
+	}
+	return d.MarathonAppID
+}
+
+// Settled is true once the deployment has reached a final status.
+func (d *Deployment) Settled() bool {
+	return d.Status == Healthy || d.Status == Failed || d.Status == Superseded
+}
+
+// running is true if any version of the app is, or is about to be, running
+// in Marathon.
+func (a *App) running() bool {
+	_, v := a.current()
+	return v != nil
+}
+
+// current returns the version of the app that is, or is about to be,
+// running in Marathon, or nil if there isn't one. While one version is
+// rolling out over another, it is the new one; a blue-green candidate or a
+// canary is not current until it is promoted.
+func (a *App) current() (string, *Version) {
+	var currentID string
+	var current *Version
+	for id, v := range *a.Versions {
+		if v.Deployment == nil || v.Deployment.Status == Failed || v.Deployment.Status == Superseded || v.Deployment.candidate() || v.Deployment.baking() {
+			continue
+		}
+		if current == nil || v.Deployment.Started().After(current.Deployment.Started()) {
+			currentID, current = id, v
+		}
+	}
+	return currentID, current
+}
+
+// busy returns a 409 if the app is part way through replacing one version
+// with another, so that nothing else can be deployed yet.
+func (a *App) busy(appID string) error {
+	for id, v := range *a.Versions {
+		if d := v.Deployment; d == nil {
+			continue
+		} else if d.Rollout != nil && !d.Settled() {
+			return hat.HttpError(409, "Version", id, "of", appID, "is still rolling out.")
+		} else if d.candidate() {
+			return hat.HttpError(409, "Version", id, "of", appID, "is a blue-green candidate; promote or abort it first.")
+		} else if d.baking() {
+			return hat.HttpError(409, "Version", id, "of", appID, "is still a canary.")
+		}
+	}
+	return nil
+}
+
+// marathonAppIDs returns the IDs of every Marathon app that any version of
+// the app may be running in.
+func (a *App) marathonAppIDs(app string) []string {
+	ids := []string{marathonAppID(app)}
+	seen := map[string]bool{ids[0]: true}
+	for _, v := range *a.Versions {
+		if v.Deployment != nil && !seen[v.Deployment.appID(app)] {
+			seen[v.Deployment.appID(app)] = true
+			ids = append(ids, v.Deployment.appID(app))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// deployVersion sends a version to the pool's Marathon, stores it, and
+// starts tracking its deployment. Any other versions of the app still being
+// tracked are superseded, and removed from Marathon if they have apps of
+// their own, except that rolling, blue-green and canary deployments
+// supersede the version they replace later. The deployment is recorded in
+// the app's history as e, which need only have its Type, Actor and Reason.
+// The caller must hold the pool's lock.
+func deployVersion(poolID, appID, versionID string, v *Version, e Event) error {
+	return deployVersionFrom(poolID, "", appID, versionID, v, e)
+}
+
+// deployVersionFrom is deployVersion, for when the live version runs in the
+// Marathon at liveHost rather than the pool's, e.g. because it is moving.
+func deployVersionFrom(poolID, liveHost, appID, versionID string, v *Version, e Event) error {
+	pool, app := state.GetPool(poolID), state.GetApp(poolID, appID)
+	if app == nil {
+		return notFound("App", poolID+"/"+appID)
+	}
+	m := newMarathon(pool.MarathonHost)
+	steps, err := planDeployment(m, liveHost, pool, app, appID, versionID, v)
+	if err != nil {
+		return err
+	}
+	currentID, current := app.current()
+	d := newDeployment()
+	d.MarathonAppID = steps.app.ID
+	if d.MarathonID, err = m.Deploy(steps.app); err != nil {
+		return hat.HttpError(502, "Unable to deploy", appID, versionID, "to Marathon:", redact(err, steps.secretValues))
+	}
+	if steps.from != nil {
+		switch v.Strategy.Type {
+		case Rolling:
+			startRollout(d, currentID, steps.from)
+		case BlueGreen:
+			startBlueGreen(appID, d, currentID, steps.from)
+		case Canary:
+			startCanary(d, currentID, steps.from, steps.app.Instances)
+		}
+	} else if currentID == versionID {
+		d.Scaling = current.Deployment.Scaling
+	}
+	d.transition(Deploying, "")
+	e.ID, e.Version, e.Strategy, e.At, e.Outcome = newID(), versionID, v.Strategy.Type.name(), d.Started(), d.Status
+	if currentID != versionID {
+		e.From = currentID
+	}
+	d.Event = e.ID
+	v.Deployment = d
+	if err := state.SetVersion(poolID, appID, versionID, v); err != nil {
+		return err
+	}
+	if err := state.AddEvent(poolID, appID, &e); err != nil {
+		return err
+	}
+	for _, id := range steps.remove {
+		if err := m.Delete(id); err != nil {
+			return hat.HttpError(502, "Unable to delete", id, "from Marathon:", err)
+		}
+	}
+	for _, id := range steps.supersede {
+		other := (*app.Versions)[id]
+		other.Deployment.transition(Superseded, "version "+versionID+" was deployed")
+		if err := state.SetDeployment(poolID, appID, id, other.Deployment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deploySteps is what deploying a version does in Marathon, as worked out by
+// planDeployment.
+type deploySteps struct {
+	app          *marathonApp // The Marathon app to create or update.
+	from         *marathonApp // The live version's app, if it stays running alongside for now.
+	supersede    []string     // Other versions whose deployments are superseded.
+	remove       []string     // Marathon apps of superseded versions, to delete.
+	secretValues []string     // The values of the secrets in app's env.
+}
+
+// planDeployment works out, without changing anything, how deployVersionFrom
+// would deploy a version of the app to the Marathon m, and fills in the
+// version's deployEnv. It fails in the same way deploying would: with 409
+// if the app is busy, or 422 if the version's secrets can't be resolved.
+// Redeploying the live version leaves it in the Marathon app it is in, with
+// as many instances as it has in the Marathon at liveHost, or m if that is
+// empty.
+func planDeployment(m *marathon, liveHost string, pool *Pool, app *App, appID, versionID string, v *Version) (*deploySteps, error) {
+	if err := app.busy(appID); err != nil {
+		return nil, err
+	}
+	currentID, current := app.current()
+	env, secretValues, err := resolveSecrets(effectiveEnv(pool.Env, app.Env, v.Env))
+	if err != nil {
+		return nil, hat.HttpError(422, "Unable to deploy", appID, versionID+":", err)
+	}
+	v.deployEnv = env
+	steps := &deploySteps{app: newMarathonApp(marathonAppID(appID), versionID, v), secretValues: secretValues}
+	if s := v.Strategy.Type; current != nil && currentID != versionID && (s == Rolling || s == BlueGreen || s == Canary) {
+		fromAppID := current.Deployment.appID(appID)
+		if steps.from, err = m.GetApp(fromAppID); err != nil && err != errMarathonNotFound {
+			return nil, hat.HttpError(502, "Unable to get", fromAppID, "from Marathon:", err)
+		} else if steps.from != nil {
+			steps.from.ID = fromAppID
+			switch s {
+			case Rolling:
+				steps.app.ID, steps.app.Instances = marathonVersionAppID(appID, versionID), 0
+			case BlueGreen:
+				steps.app.ID = marathonColourAppID(appID, otherColour(appID, fromAppID))
+			case Canary:
+				steps.app.ID, steps.app.Instances = marathonVersionAppID(appID, versionID), v.Strategy.canaryInstances()
+			}
+		}
+	}
+	if currentID == versionID {
+		live := m
+		if liveHost != "" {
+			live = newMarathon(liveHost)
+		}
+		steps.app.ID = current.Deployment.appID(appID)
+		if steps.app.Instances, err = liveInstances(live, steps.app.ID, current); err != nil {
+			return nil, hat.HttpError(502, "Unable to get", appID, "from Marathon:", err)
+		}
+	}
+	removing := map[string]bool{}
+	for id, other := range *app.Versions {
+		if id == versionID || other.Deployment == nil || other.Deployment.Status == Failed ||
+			other.Deployment.Status == Superseded || (steps.from != nil && id == currentID) {
+			continue
+		}
+		steps.supersede = append(steps.supersede, id)
+		if otherAppID := other.Deployment.appID(appID); otherAppID != steps.app.ID && !removing[otherAppID] {
+			removing[otherAppID] = true
+			steps.remove = append(steps.remove, otherAppID)
+		}
+	}
+	sort.Strings(steps.supersede)
+	sort.Strings(steps.remove)
+	return steps, nil
+}
+
+// liveInstances is how many instances of the live version v the Marathon app
+// with id runs, or if it isn't there, how many it should.
+func liveInstances(m *marathon, id string, v *Version) (int, error) {
+	ma, err := m.GetApp(id)
+	if err == errMarathonNotFound {
+		min, _ := v.wantInstances()
+		return min, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return ma.Instances, nil
+}
+
+// rollbackApp deploys an earlier version of the app again, and records that
+// in the app's history. If target is empty, the version to roll back to is
+// the one that most recently became healthy, other than the current one.
+// The caller must hold the pool's lock.
+func rollbackApp(poolID, appID, target, actor string) error {
+	_, target, v, err := getRollbackTarget(poolID, appID, target)
+	if err != nil {
+		return err
+	}
+	return deployVersion(poolID, appID, target, v, Event{Type: "rollback", Actor: actor})
+}
+
+// getRollbackTarget returns the current version of the app, and the version
+// to roll back to from it: target, or if that is empty the last healthy one.
+func getRollbackTarget(poolID, appID, target string) (from, to string, v *Version, err error) {
+	app := state.GetApp(poolID, appID)
+	if app == nil {
+		return "", "", nil, notFound("App", poolID+"/"+appID)
+	}
+	from, _ = app.current()
+	if target == "" {
+		if target = app.lastHealthy(from); target == "" {
+			return "", "", nil, hat.HttpError(409, "App", poolID+"/"+appID, "has no earlier healthy version to roll back to.")
+		}
+	}
+	v, ok := (*app.Versions)[target]
+	if !ok {
+		return "", "", nil, notFound("Version", poolID+"/"+appID+"/"+target)
+	}
+	if target == from {
+		return "", "", nil, hat.HttpError(409, "Version", target, "is already the current version of", appID+".")
+	}
+	return from, target, v, nil
+}
+
+// scaleVersion changes the number of instances of the live version of an
+// app, within its bounds. The autoscaler leaves it alone for its cooldown
+// afterwards. The caller must hold the pool's lock.
+func scaleVersion(poolID, appID, versionID string, instances int, reason, actor string) error {
+	v, err := getScalable(poolID, appID, versionID, instances)
+	if err != nil {
+		return err
+	}
+	d := v.Deployment
+	if _, err := newMarathon(state.GetPool(poolID).MarathonHost).Scale(d.appID(appID), instances); err != nil {
+		return hat.HttpError(502, "Unable to scale", appID, "in Marathon:", err)
+	}
+	s := Scaling{Target: instances, Decision: fmt.Sprintf("scaled to %d instances by hand", instances), At: time.Now().UTC()}
+	if d.Scaling != nil {
+		s.Current = d.Scaling.Current
+	}
+	d.Scaling = &s
+	if err := state.SetDeployment(poolID, appID, versionID, d); err != nil {
+		return err
+	}
+	return state.AddEvent(poolID, appID, &Event{Type: "scale", Version: versionID, Actor: actor, Reason: reason, Instances: instances, At: time.Now().UTC()})
+}
+
+// getScalable returns the version if it is live and instances is within its
+// bounds, and an error otherwise.
+func getScalable(poolID, appID, versionID string, instances int) (*Version, error) {
+	v, err := getLive(poolID, appID, versionID)
+	if err != nil {
+		return nil, err
+	}
+	max := v.MaxInstances
+	if max < v.MinInstances {
+		max = v.MinInstances
+	}
+	if instances < v.MinInstances || instances > max {
+		ve := hat.NewValidationError("Scale of", versionID, "is invalid.")
+		ve.Add("instances", fmt.Sprintf("must be from minInstances (%d) to maxInstances (%d)", v.MinInstances, max))
+		return nil, ve
+	}
+	return v, nil
+}
+
+// restartVersion has Marathon replace every instance of the live version of
+// an app. The caller must hold the pool's lock.
+func restartVersion(poolID, appID, versionID, reason, actor string) error {
+	v, err := getLive(poolID, appID, versionID)
+	if err != nil {
+		return err
+	}
+	if _, err := newMarathon(state.GetPool(poolID).MarathonHost).Restart(v.Deployment.appID(appID)); err != nil {
+		return hat.HttpError(502, "Unable to restart", appID, "in Marathon:", err)
+	}
+	return state.AddEvent(poolID, appID, &Event{Type: "restart", Version: versionID, Actor: actor, Reason: reason, At: time.Now().UTC()})
+}
+
+// getLive returns the version if it is the live version of the app, and a
+// 409 otherwise.
+func getLive(poolID, appID, versionID string) (*Version, error) {
+	app := state.GetApp(poolID, appID)
+	if app == nil {
+		return nil, notFound("App", poolID+"/"+appID)
+	}
+	v, ok := (*app.Versions)[versionID]
+	if !ok {
+		return nil, notFound("Version", poolID+"/"+appID+"/"+versionID)
+	}
+	if liveID, _ := app.current(); liveID != versionID {
+		return nil, hat.HttpError(409, "Version", versionID, "is not the live version of", appID+".")
+	}
+	return v, nil
+}
+
+// lastHealthy returns the ID of the version, other than except, that most
+// recently became healthy, or "" if there isn't one.
+func (a *App) lastHealthy(except string) string {
+	var last string
+	var lastAt time.Time
+	for id, v := range *a.Versions {
+		if id == except || v.Deployment == nil {
+			continue
+		}
+		for _, t := range v.Deployment.Transitions {
+			if t.Status == Healthy && t.At.After(lastAt) {
+				last, lastAt = id, t.At
+			}
+		}
+	}
+	return last
+}
+
+// redeployPool deploys the current version of every app in the pool again,
+// after the pool's Marathon or env has changed. If the pool has moved to a
+// different Marathon, the apps are removed from the old one once they have
+// been deployed to the new one. The caller must hold the pool's lock.
+func redeployPool(poolID, oldMarathonHost, actor string) error {
+	pool := state.GetPool(poolID)
+	for appID, app := range *pool.Apps {
+		versionID, v := app.current()
+		if v == nil {
+			continue
+		}
+		oldAppID := v.Deployment.appID(appID)
+		if err := deployVersionFrom(poolID, oldMarathonHost, appID, versionID, v, Event{Type: "redeploy", Actor: actor, Reason: "the pool's Marathon or env changed"}); err != nil {
+			return err
+		}
+		if oldMarathonHost != pool.MarathonHost {
+			if err := newMarathon(oldMarathonHost).Delete(oldAppID); err != nil {
+				return hat.HttpError(502, "Unable to delete", appID, "from the pool's old Marathon:", err)
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileDeploymentsEvery polls Marathon for the progress of every
+// deployment that has not yet settled, forever.
+func reconcileDeploymentsEvery(interval time.Duration) {
+	for {
+		reconcileDeployments()
+		time.Sleep(interval)
+	}
+}
+
+func reconcileDeployments() {
+	for _, poolID := range state.GetPoolIDs() {
+		reconcilePoolDeployments(poolID)
+	}
+}
+
+func reconcilePoolDeployments(poolID string) {
+	health := checkCanaries(poolID)
+	defer state.LockPool(poolID)()
+	pool := state.GetPool(poolID)
+	if pool == nil {
+		return
+	}
+	m := newMarathon(pool.MarathonHost)
+	running, err := m.GetDeploymentIDs()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for appID, app := range *pool.Apps {
+		for versionID, v := range *app.Versions {
+			if v.Deployment == nil || v.Deployment.Settled() {
+				continue
+			}
+			var changed bool
+			var err error
+			if v.Deployment.Rollout != nil {
+				changed, err = reconcileRollout(m, poolID, appID, versionID, v, running)
+			} else if v.Deployment.Bake != nil {
+				changed, err = reconcileCanary(m, poolID, appID, versionID, v, running, health)
+			} else if v.Deployment.Cutover != nil {
+				changed, err = reconcileBlueGreen(m, appID, versionID, v.Deployment, running)
+			} else {
+				changed, err = reconcileDeployment(m, appID, versionID, v.Deployment, running)
+			}
+			if err != nil {
+				log.Error(err)
+			} else if changed {
+				if err := state.SetDeployment(poolID, appID, versionID, v.Deployment); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}
+}
+
+// reconcileDeployment works out the status of d from what Marathon is doing.
+// It returns true if the status changed.
+func reconcileDeployment(m *marathon, appID, versionID string, d *Deployment, running map[string]bool) (bool, error) {
+	if running[d.MarathonID] {
+		if time.Since(d.Started()) > deploymentTimeout {
+			return d.transition(Failed, "not healthy after "+deploymentTimeout.String()), nil
+		}
+		return d.transition(Deploying, ""), nil
+	}
+	app, err := m.GetApp(d.appID(appID))
+	if err == errMarathonNotFound {
+		return d.transition(Failed, "app no longer exists in Marathon"), nil
+	} else if err != nil {
+		return false, err
+	}
+	if app.Labels["version"] != versionID {
+		return d.transition(Superseded, "Marathon is running version "+app.Labels["version"]), nil
+	}
+	if app.ready() >= app.Instances {
+		return d.transition(Healthy, ""), nil
+	}
+	if time.Since(d.Started()) > deploymentTimeout {
+		return d.transition(Failed, "not healthy after "+deploymentTimeout.String()), nil
+	}
+	return false, nil
+}
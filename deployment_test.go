@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestRedeployKeepsScale(t *testing.T) {
+	f, g := newFakeMarathon(), newFakeMarathon()
+	defer f.Close()
+	defer g.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 2, "maxInstances": 10}`)
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "POST", "/pools/p/apps/web/versions/1/scale", `{"instances": 5}`)
+
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`", "env": {"A": "1"}}`)
+	if a := f.app("/web"); a.Instances != 5 || a.Env["A"] != "1" {
+		t.Errorf("after changing the pool's env, got %d instances with env %v; want 5 with A=1", a.Instances, a.Env)
+	}
+	reconcilePoolDeployments("p")
+	if d := state.GetVersion("p", "web", "1").Deployment; d.Scaling == nil || d.Scaling.Target != 5 {
+		t.Errorf("got scaling %+v, want a target of 5", d.Scaling)
+	}
+	reconcilePoolDrift("p")
+	if problems := state.GetDrift("p").Problems; len(problems) != 0 {
+		t.Errorf("got drift %+v", problems)
+	}
+
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+g.URL+`", "env": {"A": "1"}}`)
+	if a := g.app("/web"); a == nil || a.Instances != 5 {
+		t.Errorf("after moving Marathon, got %+v; want 5 instances", a)
+	}
+	if f.app("/web") != nil {
+		t.Error("the app is still in the old Marathon")
+	}
+
+	mustRequest(t, s, "POST", "/pools/p/apps/web/versions/1/scale", `{"instances": 7}`)
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+g.URL+`", "env": {"A": "2"}}`)
+	if a := g.app("/web"); a.Instances != 7 {
+		t.Errorf("after scaling and redeploying again, got %d instances; want 7", a.Instances)
+	}
+}
+
+// lastEvent is the latest event in the app's history.
+func lastEvent(t *testing.T, poolID, appID string) *Event {
+	h := *state.GetApp(poolID, appID).History
+	ids := []string{}
+	for id, _ := range h {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		t.Fatal("the app has no history")
+	}
+	sort.Strings(ids)
+	return h[ids[len(ids)-1]]
+}
+
+func TestRollback(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	for _, id := range []string{"1", "2", "3"} {
+		mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/"+id, `{"command": ["./web", "-v`+id+`"], "minInstances": 1}`)
+		reconcilePoolDeployments("p")
+	}
+
+	mustRequest(t, s, "POST", "/pools/p/apps/web/rollback", `{}`)
+	if got := f.app("/web").Labels["version"]; got != "2" {
+		t.Errorf("rolling back by default deployed version %s, want 2", got)
+	}
+	if e := lastEvent(t, "p", "web"); e.Type != "rollback" || e.Version != "2" || e.From != "3" {
+		t.Errorf("got event %+v, want a rollback to 2 from 3", e)
+	}
+	reconcilePoolDeployments("p")
+
+	mustRequest(t, s, "POST", "/pools/p/apps/web/rollback", `{"version": "1"}`)
+	if got := f.app("/web").Labels["version"]; got != "1" {
+		t.Errorf("rolling back to version 1 deployed version %s", got)
+	}
+	if e := lastEvent(t, "p", "web"); e.Type != "rollback" || e.Version != "1" || e.From != "2" {
+		t.Errorf("got event %+v, want a rollback to 1 from 2", e)
+	}
+	reconcilePoolDeployments("p")
+
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{"version": "1"}`, 409},
+		{`{"version": "9"}`, 404},
+	} {
+		if status, body := request(t, s, "POST", "/pools/p/apps/web/rollback", c.body); status != c.want {
+			t.Errorf("rolling back with %s: got %d %s, want %d", c.body, status, body, c.want)
+		}
+	}
+
+	f.stuck = true
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/4", `{"command": ["./web", "-v4"], "minInstances": 1, "strategy": {"type": "rolling"}}`)
+	reconcilePoolDeployments("p")
+	if status, body := request(t, s, "POST", "/pools/p/apps/web/rollback", `{"version": "2"}`); status != 409 {
+		t.Errorf("rolling back during a rollout: got %d %s, want 409", status, body)
+	}
+}
+
+func TestHistoryRecordsOutcomes(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	f.stuck = true
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+	e := lastEvent(t, "p", "web")
+	if e.Type != "deploy" || e.Version != "1" || e.From != "" || e.Outcome != Deploying || e.EndedAt != nil {
+		t.Errorf("while deploying, got event %+v", e)
+	}
+
+	f.finish()
+	reconcilePoolDeployments("p")
+	if e := lastEvent(t, "p", "web"); e.Outcome != Healthy || e.EndedAt == nil || e.EndedAt.Before(e.At) {
+		t.Errorf("once healthy, got event %+v", e)
+	}
+
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2", `{"command": ["./web", "-v2"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+	if e := lastEvent(t, "p", "web"); e.Version != "2" || e.From != "1" || e.Outcome != Healthy || e.EndedAt == nil {
+		t.Errorf("after deploying version 2, got event %+v", e)
+	}
+	if h := *state.GetApp("p", "web").History; len(h) != 2 {
+		t.Errorf("got %d events, want 2", len(h))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How often to compare each pool with what its Marathon runs.
+var driftInterval = time.Minute
+
+type DriftMode string
+
+const (
+	// DriftReport, the default, only reports drift.
+	DriftReport = DriftMode("")
+	// DriftCorrect puts Marathon back as the pool says it should be.
+	DriftCorrect = DriftMode("correct")
+)
+
+// The kinds of drift.
+const (
+	// DriftMissing is a live version whose Marathon app is gone.
+	DriftMissing = "missing"
+	// DriftVersion is a Marathon app running a different version than the
+	// live one.
+	DriftVersion = "version"
+	// DriftInstances is a Marathon app with a different number of instances
+	// than the live version should have.
+	DriftInstances = "instances"
+	// DriftUnexpected is a Marathon app deploy made that no app in any pool
+	// on that Marathon could be running in.
+	DriftUnexpected = "unexpected"
+)
+
+// Drift is how what a pool's Marathon runs differed from the pool when they
+// were last compared, and what was done about it.
+type Drift struct {
+	Mode      DriftMode      `json:"mode"`
+	CheckedAt time.Time      `json:"checkedAt"`
+	Problems  []DriftProblem `json:"problems"`
+	Error     string         `json:"error,omitempty"`
+}
+
+type DriftProblem struct {
+	Kind          string `json:"kind"`
+	App           string `json:"app,omitempty"`
+	Version       string `json:"version,omitempty"`
+	MarathonAppID string `json:"marathonAppId"`
+	Detail        string `json:"detail"`
+	Corrected     bool   `json:"corrected"`
+	Error         string `json:"error,omitempty"`
+}
+
+// reconcileDriftEvery compares every pool with its Marathon, forever.
+func reconcileDriftEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		reconcileDrift()
+	}
+}
+
+func reconcileDrift() {
+	for _, poolID := range state.GetPoolIDs() {
+		reconcilePoolDrift(poolID)
+	}
+}
+
+// reconcilePoolDrift compares the live version of each app in the pool with
+// what Marathon runs, and looks for apps deploy made in Marathon that no pool
+// knows about. Apps with deployments in progress, either here or in
+// Marathon, are left alone. In DriftCorrect mode, missing apps and apps
+// running the wrong version are redeployed, instances are scaled back, and
+// unexpected apps are deleted.
+func reconcilePoolDrift(poolID string) {
+	defer state.LockPool(poolID)()
+	pool := state.GetPool(poolID)
+	if pool == nil {
+		return
+	}
+	drift := &Drift{pool.DriftMode, time.Now().UTC(), []DriftProblem{}, ""}
+	defer state.SetDrift(poolID, drift)
+	m := newMarathon(pool.MarathonHost)
+	running, err := m.GetApps()
+	if err != nil {
+		drift.Error = "Unable to list apps in Marathon: " + err.Error()
+		return
+	}
+	appIDs := make([]string, 0, len(*pool.Apps))
+	for id, _ := range *pool.Apps {
+		appIDs = append(appIDs, id)
+	}
+	sort.Strings(appIDs)
+	for _, appID := range appIDs {
+		app := (*pool.Apps)[appID]
+		versionID, v := app.current()
+		if v == nil || v.Deployment.Status != Healthy || app.busy(appID) != nil {
+			continue
+		}
+		id := v.Deployment.appID(appID)
+		min, max := v.wantInstances()
+		want := min
+		p := DriftProblem{App: appID, Version: versionID, MarathonAppID: id}
+		ma, ok := running[id]
+		switch {
+		case !ok:
+			p.Kind, p.Detail = DriftMissing, "not in Marathon"
+		case len(ma.Deployments) != 0:
+			continue
+		case ma.Labels["version"] != versionID:
+			p.Kind, p.Detail = DriftVersion, "running version "+ma.Labels["version"]
+		case ma.Instances < min || ma.Instances > max:
+			if ma.Instances > max {
+				want = max
+			}
+			p.Kind, p.Detail = DriftInstances, fmt.Sprintf("%d instances, not %d", ma.Instances, want)
+		default:
+			continue
+		}
+		if pool.DriftMode == DriftCorrect {
+			if p.Kind == DriftInstances {
+				_, err = m.Scale(id, want)
+			} else {
+				err = deployVersion(poolID, appID, versionID, v, Event{Type: "redeploy", Actor: systemActor, Reason: "to correct drift: " + p.Detail})
+			}
+			p.markCorrected(err)
+		}
+		drift.Problems = append(drift.Problems, p)
+	}
+	known := knownMarathonAppIDs(pool.MarathonHost)
+	ids := make([]string, 0, len(running))
+	for id, _ := range running {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		ma := running[id]
+		if ma.Labels["version"] == "" || len(ma.Deployments) != 0 || known[id] {
+			continue
+		}
+		p := DriftProblem{Kind: DriftUnexpected, MarathonAppID: id, Detail: "running version " + ma.Labels["version"] + ", but not in any pool"}
+		if pool.DriftMode == DriftCorrect {
+			p.markCorrected(m.Delete(id))
+		}
+		drift.Problems = append(drift.Problems, p)
+	}
+}
+
+func (p *DriftProblem) markCorrected(err error) {
+	if err != nil {
+		p.Error = err.Error()
+	} else {
+		p.Corrected = true
+	}
+}
+
+// wantInstances is the least and most instances the live version should
+// have. An autoscaled version may have any number within its bounds, since
+// the autoscaler waits out its cooldown before scaling to what it wants; a
+// version scaled by hand should have what it was scaled to.
+func (v *Version) wantInstances() (min, max int) {
+	if v.Autoscale != nil {
+		if v.MaxInstances > v.MinInstances {
+			return v.MinInstances, v.MaxInstances
+		}
+		return v.MinInstances, v.MinInstances
+	}
+	if s := v.Deployment.Scaling; s != nil && s.Target != 0 {
+		return s.Target, s.Target
+	}
+	return v.MinInstances, v.MinInstances
+}
+
+// knownMarathonAppIDs is the Marathon apps that any app in any pool on host
+// has, or could have, run in, whatever became of its deployments: e.g. a
+// failed deployment of a new version in the app's own Marathon app leaves
+// the superseded version running there.
+func knownMarathonAppIDs(host string) map[string]bool {
+	known := map[string]bool{}
+	for _, poolID := range state.GetPoolIDs() {
+		pool := state.GetPool(poolID)
+		if pool == nil || newMarathon(pool.MarathonHost).URL != newMarathon(host).URL {
+			continue
+		}
+		for appID, app := range *pool.Apps {
+			for _, id := range app.marathonAppIDs(appID) {
+				known[id] = true
+			}
+		}
+	}
+	return known
+}
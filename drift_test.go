@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDriftLeavesAppsOfFailedDeploymentsAlone(t *testing.T) {
+	defer func(timeout time.Duration) { deploymentTimeout = timeout }(deploymentTimeout)
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`", "driftMode": "correct"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+	// Version 2 replaces 1 in the same Marathon app, but never comes up.
+	f.stuck = true
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2", `{"command": ["./web"], "minInstances": 1}`)
+	deploymentTimeout = 0
+	reconcilePoolDeployments("p")
+	if d := state.GetVersion("p", "web", "2").Deployment; d.Status != Failed {
+		t.Fatalf("version 2 is %s, want failed", d.Status)
+	}
+	f.finish()
+	reconcilePoolDrift("p")
+	if f.app("/web") == nil {
+		t.Error("the app was deleted from Marathon")
+	}
+	for _, p := range state.GetDrift("p").Problems {
+		if p.Kind == DriftUnexpected {
+			t.Errorf("got %+v", p)
+		}
+	}
+}
+
+func TestDriftAllowsAutoscaledInstancesWithinBounds(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1",
+		`{"command": ["./web"], "minInstances": 2, "maxInstances": 10, "autoscale": {"metricUri": "/load", "target": 50}}`)
+	reconcilePoolDeployments("p")
+	// The autoscaler wants 10, but is waiting out its cooldown after being
+	// scaled to 3 by hand.
+	mustRequest(t, s, "POST", "/pools/p/apps/web/versions/1/scale", `{"instances": 3}`)
+	d := state.GetVersion("p", "web", "1").Deployment
+	d.Scaling.Target = 10
+	if err := state.SetDeployment("p", "web", "1", d); err != nil {
+		t.Fatal(err)
+	}
+	reconcilePoolDrift("p")
+	if problems := state.GetDrift("p").Problems; len(problems) != 0 {
+		t.Errorf("at 3 instances, got %+v", problems)
+	}
+
+	if _, err := newMarathon(f.URL).Scale("/web", 12); err != nil {
+		t.Fatal(err)
+	}
+	reconcilePoolDrift("p")
+	if problems := state.GetDrift("p").Problems; len(problems) != 1 || problems[0].Detail != "12 instances, not 10" {
+		t.Errorf("at 12 instances, got %+v", problems)
+	}
+}
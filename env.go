@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/opentable/hat"
+	"strings"
+)
+
+// effectiveEnv is the env a version is deployed with: the pool's env, then
+// the app's, then the version's, each overriding the ones before it.
+func effectiveEnv(layers ...map[string]string) map[string]string {
+	env := map[string]string{}
+	for _, layer := range layers {
+		for k, v := range layer {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// annotateEnv fills in the effective env of each of the app's versions.
+func (a *App) annotateEnv(pool *Pool) {
+	for _, v := range *a.Versions {
+		v.EffectiveEnv = effectiveEnv(pool.Env, a.Env, v.Env)
+	}
+}
+
+func validateEnv(ve *hat.ValidationError, env map[string]string) {
+	for k, v := range env {
+		if k == "" || strings.Contains(k, "=") {
+			ve.Add("env", quot(k), "is not a valid env var name")
+		}
+		if _, _, _, err := parseSecretRef(v); err != nil {
+			ve.Add("env."+k, "is a secret reference that", err.Error())
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// gitRepo is a local working copy of a remote git repository. All paths
+// passed to its methods are relative to the root of the working copy.
+// Callers must hold its lock around any sequence of changes and the commit
+// that follows them.
+type gitRepo struct {
+	sync.Mutex
+	URL string
+	Dir string
+}
+
+func cloneGitRepo(url string) (*gitRepo, error) {
+	dir, err := ioutil.TempDir("", "deploy-")
+	if err != nil {
+		return nil, err
+	}
+	g := &gitRepo{URL: url, Dir: dir}
+	if _, err := g.git("clone", "--quiet", url, "."); err != nil {
+		return nil, err
+	}
+	// Commits are made by the service itself, so it needs an identity
+	// regardless of the global git config on the host.
+	if _, err := g.git("config", "user.name", "deploy"); err != nil {
+		return nil, err
+	}
+	if _, err := g.git("config", "user.email", "deploy@localhost"); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *gitRepo) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.Dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.New("git " + strings.Join(args, " ") + ": " + err.Error() + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (g *gitRepo) path(path string) string {
+	return filepath.Join(g.Dir, filepath.FromSlash(path))
+}
+
+// Glob returns the paths matching pattern, relative to the working copy.
+func (g *gitRepo) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(g.path(pattern))
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range matches {
+		if rel, err := filepath.Rel(g.Dir, m); err != nil {
+			return nil, err
+		} else {
+			matches[i] = filepath.ToSlash(rel)
+		}
+	}
+	return matches, nil
+}
+
+func (g *gitRepo) Exists(path string) bool {
+	_, err := os.Stat(g.path(path))
+	return err == nil
+}
+
+func (g *gitRepo) ReadJSON(path string, v interface{}) error {
+	if data, err := ioutil.ReadFile(g.path(path)); err != nil {
+		return err
+	} else {
+		return json.Unmarshal(data, v)
+	}
+}
+
+// WriteJSON writes v as indented JSON to path, and stages it.
+func (g *gitRepo) WriteJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(g.path(path)), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(g.path(path), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	_, err = g.git("add", "--", path)
+	return err
+}
+
+// Remove deletes path, which may be a directory, and stages the deletion.
+func (g *gitRepo) Remove(path string) error {
+	if _, err := g.git("rm", "-r", "--quiet", "--ignore-unmatch", "--", path); err != nil {
+		return err
+	}
+	return os.RemoveAll(g.path(path))
+}
+
+// Pull brings the working copy up to date with the remote. It is for repos
+// that are only read, so it discards any local changes.
+func (g *gitRepo) Pull() error {
+	g.Lock()
+	defer g.Unlock()
+	if _, err := g.git("fetch", "--quiet", "origin", "HEAD"); err != nil {
+		return err
+	}
+	_, err := g.git("reset", "--quiet", "--hard", "FETCH_HEAD")
+	return err
+}
+
+// Commit commits everything staged and pushes it to the remote. It does
+// nothing if there is nothing staged.
+func (g *gitRepo) Commit(message string) error {
+	return g.CommitAs("", message)
+}
+
+// CommitAs is Commit with the given author, e.g. "Name <email>", rather than
+// the repo's own identity.
+func (g *gitRepo) CommitAs(author, message string) error {
+	if _, err := g.git("diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+	args := []string{"commit", "--quiet", "-m", message}
+	if author != "" {
+		args = append(args, "--author", author)
+	}
+	if _, err := g.git(args...); err != nil {
+		return err
+	}
+	return g.push()
+}
+
+// push pushes HEAD to the remote. If someone else has pushed to it since we
+// last did, our commits are rebased onto theirs first.
+func (g *gitRepo) push() error {
+	if _, err := g.git("push", "--quiet", "origin", "HEAD"); err == nil {
+		return nil
+	}
+	if _, err := g.git("pull", "--quiet", "--rebase", "origin", "HEAD"); err != nil {
+		g.git("rebase", "--abort")
+		return err
+	}
+	_, err := g.git("push", "--quiet", "origin", "HEAD")
+	return err
+}
+
+// Head is the commit checked out, or "" if there isn't one yet.
+func (g *gitRepo) Head() string {
+	head, err := g.git("rev-parse", "--verify", "--quiet", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(head)
+}
+
+// ResetTo throws away every commit since head, and every change not yet
+// committed, e.g. to undo a commit that couldn't be pushed. An empty head
+// is from before the first commit.
+func (g *gitRepo) ResetTo(head string) error {
+	if head == "" {
+		g.git("update-ref", "-d", "HEAD")
+		if _, err := g.git("read-tree", "--empty"); err != nil {
+			return err
+		}
+	} else if _, err := g.git("reset", "--quiet", "--hard", head); err != nil {
+		return err
+	}
+	_, err := g.git("clean", "--quiet", "-d", "--force")
+	return err
+}
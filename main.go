@@ -3,27 +3,53 @@ package main
 import (
 	"github.com/opentable/hat"
 	"github.com/opentable/ot-go-lib/env"
-	"github.com/opentable/ot-go-lib/gutter"
 	"github.com/opentable/ot-go-lib/logging"
 	"github.com/opentable/ot-go-lib/service"
+	"time"
 )
 
+// These are set up by main, rather than when the package is initialised, so
+// that tests can run without the service's environment.
 var (
-	stateGitURL  = env.RequireString("OT_DEPLOY_STATE_REPO_URL")
-	configGitURL = env.RequireString("OT_CLOUD_PLATFORM_CONFIG_REPO")
-	log          = logging.StandardConfig("deploy").StartupLog(0)
-	gitState     = initGitClient(stateGitURL)
-	gitConfig    = initGitClient(configGitURL)
-	svc          service.Service
+	log       logging.StartupLog
+	auditLog  logging.Log
+	gitState  *gitRepo
+	gitConfig *gitRepo
 )
 
+// How often to poll Marathon for the progress of deployments.
+var deploymentPollInterval = 5 * time.Second
+
 func main() {
+	logs := logging.StandardConfig("deploy")
+	log, auditLog = logs.StartupLog(0), logs.Log("audit", 0)
+	gitState = initGitRepo(env.RequireString("OT_DEPLOY_STATE_REPO_URL"))
+	gitConfig = initGitRepo(env.RequireString("OT_CLOUD_PLATFORM_CONFIG_REPO"))
+	if err := state.Load(gitState); err != nil {
+		log.Fatal(err)
+		return
+	}
+	keys, err := loadKeys(env.RequireString("OT_DEPLOY_KEYS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	secrets = fileSecrets{env.StringOrDefault("OT_DEPLOY_SECRETS_DIR", "secrets")}
+	if trustedProxies, err = parseTrustedProxies(env.StringOrDefault("OT_DEPLOY_TRUSTED_PROXIES", "")); err != nil {
+		log.Fatal(err)
+		return
+	}
+	syncConfig()
+	go syncConfigEvery(configSyncInterval)
+	go reconcileDeploymentsEvery(deploymentPollInterval)
+	go autoscaleEvery(autoscaleInterval)
+	go reconcileDriftEvery(driftInterval)
 	s, err := hat.NewServer(Root{})
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	svc, err := service.NewHTTPServiceFromEnv("deploy", s.ServeHTTP)
+	svc, err := service.NewHTTPServiceFromEnv("deploy", authenticated(keys, audited(s.ServeHTTP)))
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -31,13 +57,10 @@ func main() {
 	svc.Start()
 }
 
-func initGitClient(url string) gutter.Client {
-	git, err := gutter.NewGitClient()
+func initGitRepo(url string) *gitRepo {
+	git, err := cloneGitRepo(url)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := git.Clone(url); err != nil {
-		log.Fatal(err)
-	}
 	return git
 }
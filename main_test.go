@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/opentable/hat"
+	"github.com/opentable/ot-go-lib/logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logs := logging.NewLogConfig("deploy", "localhost", 0)
+	log, auditLog = logs.NewStartupLog(0, logging.NewStderrTarget()), logs.NewLog("audit", 0)
+	secrets = fileSecrets{os.TempDir()}
+	os.Exit(m.Run())
+}
+
+// resetState empties the state, which lives only in memory in tests.
+func resetState() {
+	state = State{pools: Pools{}, poolLocks: map[string]*sync.Mutex{}, auditing: map[string]*AuditRecord{},
+		audit: AuditLog{}, drift: map[string]*Drift{}}
+}
+
+// newTestServer serves the API, without authentication, from an empty state.
+func newTestServer(t *testing.T) *httptest.Server {
+	resetState()
+	s, err := hat.NewServer(Root{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(audited(s.ServeHTTP))
+}
+
+// request makes a request of s, and returns the status and body of the
+// response.
+func request(t *testing.T, s *httptest.Server, method, path, body string) (int, string) {
+	status, _, data := requestWithHeader(t, s, method, path, body, nil)
+	return status, data
+}
+
+// requestWithHeader is request, with header, which also returns the header
+// of the response.
+func requestWithHeader(t *testing.T, s *httptest.Server, method, path, body string, header http.Header) (int, http.Header, string) {
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(data)
+}
+
+// mustRequest is request, failing the test unless the response is a 2xx.
+func mustRequest(t *testing.T, s *httptest.Server, method, path, body string) string {
+	status, data := request(t, s, method, path, body)
+	if status < 200 || status > 299 {
+		t.Fatalf("%s %s: %d %s", method, path, status, data)
+	}
+	return data
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// marathon is a client for the Marathon REST API of a single pool.
+type marathon struct {
+	URL    string
+	Client *http.Client
+}
+
+// marathonTimeout is how long any single call to Marathon may take.
+var marathonTimeout = 10 * time.Second
+
+// newMarathon creates a client for host, which is either a host:port or a
+// full URL (the latter is handy for pointing at a fake Marathon).
+func newMarathon(host string) *marathon {
+	url := strings.TrimSuffix(host, "/")
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	return &marathon{url, &http.Client{Timeout: marathonTimeout}}
+}
+
+// marathonApp is the subset of Marathon's app definition that deploy uses.
+type marathonApp struct {
+	ID           string                `json:"id"`
+	Args         []string              `json:"args,omitempty"`
+	URIs         []string              `json:"uris,omitempty"`
+	CPUs         float64               `json:"cpus"`
+	Mem          float64               `json:"mem"`
+	Disk         float64               `json:"disk"`
+	Instances    int                   `json:"instances"`
+	Ports        []int                 `json:"ports"`
+	RequirePorts bool                  `json:"requirePorts,omitempty"`
+	HealthChecks []marathonHealthCheck `json:"healthChecks,omitempty"`
+	Env          map[string]string     `json:"env,omitempty"`
+	Labels       map[string]string     `json:"labels,omitempty"`
+	Upgrade      *marathonUpgrade      `json:"upgradeStrategy,omitempty"`
+	Deployments  []marathonDeployment  `json:"deployments,omitempty"`
+	Tasks        []marathonTask        `json:"tasks,omitempty"`
+	TasksRunning int                   `json:"tasksRunning,omitempty"`
+	TasksHealthy int                   `json:"tasksHealthy,omitempty"`
+}
+
+// ready is the number of tasks that are up: healthy if the app has health
+// checks, otherwise merely running.
+func (a *marathonApp) ready() int {
+	if len(a.HealthChecks) != 0 {
+		return a.TasksHealthy
+	}
+	return a.TasksRunning
+}
+
+type marathonHealthCheck struct {
+	Protocol  string `json:"protocol"`
+	Path      string `json:"path"`
+	PortIndex int    `json:"portIndex"`
+}
+
+type marathonUpgrade struct {
+	MinimumHealthCapacity float64 `json:"minimumHealthCapacity"`
+	MaximumOverCapacity   float64 `json:"maximumOverCapacity"`
+}
+
+type marathonTask struct {
+	Host  string `json:"host"`
+	Ports []int  `json:"ports"`
+}
+
+// addr is the host:port of the task's first port, if it has one.
+func (t marathonTask) addr() (string, bool) {
+	if len(t.Ports) == 0 {
+		return "", false
+	}
+	return t.Host + ":" + strconv.Itoa(t.Ports[0]), true
+}
+
+type marathonDeployment struct {
+	ID string `json:"id"`
+}
+
+// marathonAppID is the ID of the Marathon app that runs app, unless a
+// strategy needs more than one version running at once.
+func marathonAppID(app string) string {
+	return "/" + app
+}
+
+// marathonVersionAppID is the ID of the Marathon app that runs a version on
+// its own, alongside other versions of the app.
+func marathonVersionAppID(app, version string) string {
+	return "/" + app + "-" + version
+}
+
+// marathonColourAppID is the ID of the Marathon app that runs the blue or
+// green side of a blue-green deployment.
+func marathonColourAppID(app, colour string) string {
+	return "/" + app + "-" + colour
+}
+
+// newMarathonApp maps a version of an app onto the Marathon app with id.
+// The version ID is kept in the "version" label so that we can tell which
+// version Marathon is running. The version's deployEnv must be filled in.
+func newMarathonApp(id, version string, v *Version) *marathonApp {
+	r := v.Requirements
+	ports := r.SpecificPorts
+	if len(ports) == 0 {
+		// Port 0 asks Marathon to assign a port.
+		ports = make([]int, r.Ports)
+	}
+	ma := &marathonApp{
+		ID:           id,
+		Args:         v.Command,
+		URIs:         v.ArtifactURLs,
+		CPUs:         r.CPU,
+		Mem:          r.MemoryMB,
+		Disk:         r.DiskMB,
+		Instances:    v.MinInstances,
+		Ports:        ports,
+		RequirePorts: len(r.SpecificPorts) != 0,
+		Env:          v.deployEnv,
+		Labels:       map[string]string{"version": version},
+	}
+	if v.HealthURI != "" && len(ports) != 0 {
+		ma.HealthChecks = []marathonHealthCheck{{"HTTP", v.HealthURI, 0}}
+	}
+	if v.Strategy.Type == Recreate {
+		// Kill every old task before starting any new ones.
+		ma.Upgrade = &marathonUpgrade{0, 0}
+	}
+	return ma
+}
+
+// Deploy creates or updates app in Marathon, and returns the ID of the
+// Marathon deployment that resulted.
+func (m *marathon) Deploy(app *marathonApp) (string, error) {
+	if _, err := m.GetApp(app.ID); err == errMarathonNotFound {
+		created := &marathonApp{}
+		if err := m.do("POST", "/v2/apps", app, created); err != nil {
+			return "", err
+		}
+		if len(created.Deployments) == 0 {
+			return "", nil
+		}
+		return created.Deployments[0].ID, nil
+	} else if err != nil {
+		return "", err
+	}
+	updated := &struct {
+		DeploymentID string `json:"deploymentId"`
+	}{}
+	if err := m.do("PUT", "/v2/apps"+app.ID, app, updated); err != nil {
+		return "", err
+	}
+	return updated.DeploymentID, nil
+}
+
+// Scale changes the number of instances of the app with id, and returns the
+// ID of the Marathon deployment that resulted.
+func (m *marathon) Scale(id string, instances int) (string, error) {
+	updated := &struct {
+		DeploymentID string `json:"deploymentId"`
+	}{}
+	if err := m.do("PUT", "/v2/apps"+id, map[string]int{"instances": instances}, updated); err != nil {
+		return "", err
+	}
+	return updated.DeploymentID, nil
+}
+
+// Restart replaces every task of the app with id, and returns the ID of the
+// Marathon deployment that resulted.
+func (m *marathon) Restart(id string) (string, error) {
+	restarted := &struct {
+		DeploymentID string `json:"deploymentId"`
+	}{}
+	if err := m.do("POST", "/v2/apps"+id+"/restart", nil, restarted); err != nil {
+		return "", err
+	}
+	return restarted.DeploymentID, nil
+}
+
+// Delete destroys app in Marathon, killing all its tasks. Deleting an app
+// that does not exist is not an error.
+func (m *marathon) Delete(id string) error {
+	if err := m.do("DELETE", "/v2/apps"+id, nil, nil); err != nil && err != errMarathonNotFound {
+		return err
+	}
+	return nil
+}
+
+var errMarathonNotFound = errors.New("not found in Marathon")
+
+func (m *marathon) GetApp(id string) (*marathonApp, error) {
+	resp := &struct {
+		App *marathonApp `json:"app"`
+	}{}
+	if err := m.do("GET", "/v2/apps"+id, nil, resp); err != nil {
+		return nil, err
+	}
+	return resp.App, nil
+}
+
+// GetApps returns every app in Marathon, by ID.
+func (m *marathon) GetApps() (map[string]*marathonApp, error) {
+	resp := &struct {
+		Apps []*marathonApp `json:"apps"`
+	}{}
+	if err := m.do("GET", "/v2/apps", nil, resp); err != nil {
+		return nil, err
+	}
+	apps := make(map[string]*marathonApp, len(resp.Apps))
+	for _, a := range resp.Apps {
+		apps[a.ID] = a
+	}
+	return apps, nil
+}
+
+// GetDeploymentIDs returns the IDs of all deployments Marathon has in
+// progress.
+func (m *marathon) GetDeploymentIDs() (map[string]bool, error) {
+	deployments := []marathonDeployment{}
+	if err := m.do("GET", "/v2/deployments", nil, &deployments); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(deployments))
+	for _, d := range deployments {
+		ids[d.ID] = true
+	}
+	return ids, nil
+}
+
+// do sends body as JSON to path, and decodes the response into out.
+func (m *marathon) do(method, path string, body, out interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, m.URL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == 404 {
+		return errMarathonNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("marathon " + method + " " + path + ": " + strconv.Itoa(resp.StatusCode) + ": " + string(data))
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMarathon is an in-process Marathon that keeps its apps in memory. Its
+// deployments finish at once, with every task healthy, unless it is stuck,
+// in which case they stay in progress with no tasks up. Tasks listen on
+// taskAddr, if it is set.
+type fakeMarathon struct {
+	*httptest.Server
+	sync.Mutex
+	apps        map[string]*marathonApp
+	deployments map[string]bool
+	requests    []string
+	stuck       bool
+	taskAddr    string
+}
+
+func newFakeMarathon() *fakeMarathon {
+	f := &fakeMarathon{apps: map[string]*marathonApp{}, deployments: map[string]bool{}}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeMarathon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	id := strings.TrimPrefix(r.URL.Path, "/v2/apps")
+	switch {
+	case r.URL.Path == "/v2/deployments":
+		deployments := []marathonDeployment{}
+		for id, _ := range f.deployments {
+			deployments = append(deployments, marathonDeployment{id})
+		}
+		json.NewEncoder(w).Encode(deployments)
+	case !strings.HasPrefix(r.URL.Path, "/v2/apps"):
+		w.WriteHeader(404)
+	case r.Method == "GET" && id == "":
+		apps := []*marathonApp{}
+		for _, a := range f.apps {
+			apps = append(apps, a)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"apps": apps})
+	case r.Method == "POST" && id == "":
+		a := &marathonApp{}
+		json.NewDecoder(r.Body).Decode(a)
+		if _, ok := f.apps[a.ID]; ok {
+			w.WriteHeader(409)
+			return
+		}
+		f.apps[a.ID] = a
+		a.Deployments = []marathonDeployment{{f.deploy(a)}}
+		json.NewEncoder(w).Encode(a)
+	case r.Method == "POST" && strings.HasSuffix(id, "/restart"):
+		a, ok := f.apps[strings.TrimSuffix(id, "/restart")]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"deploymentId": f.deploy(a)})
+	case f.apps[id] == nil:
+		w.WriteHeader(404)
+	case r.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{"app": f.apps[id]})
+	case r.Method == "PUT":
+		// Marathon only changes the fields that are given.
+		a := f.apps[id]
+		json.NewDecoder(r.Body).Decode(a)
+		a.ID = id
+		json.NewEncoder(w).Encode(map[string]string{"deploymentId": f.deploy(a)})
+	case r.Method == "DELETE":
+		delete(f.apps, id)
+		json.NewEncoder(w).Encode(map[string]string{"deploymentId": f.deploy(&marathonApp{})})
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// deploy starts a deployment of a, and returns its ID.
+func (f *fakeMarathon) deploy(a *marathonApp) string {
+	id := "d" + strconv.Itoa(len(f.requests))
+	a.Deployments = nil
+	if f.stuck {
+		f.deployments[id] = true
+		a.TasksRunning, a.TasksHealthy, a.Tasks = 0, 0, nil
+		return id
+	}
+	a.TasksRunning, a.TasksHealthy, a.Tasks = a.Instances, a.Instances, nil
+	if host, port, err := net.SplitHostPort(f.taskAddr); err == nil {
+		p, _ := strconv.Atoi(port)
+		for i := 0; i < a.Instances; i++ {
+			a.Tasks = append(a.Tasks, marathonTask{host, []int{p}})
+		}
+	}
+	return id
+}
+
+// finish finishes every deployment in progress.
+func (f *fakeMarathon) finish() {
+	f.Lock()
+	defer f.Unlock()
+	f.stuck = false
+	for id, _ := range f.deployments {
+		delete(f.deployments, id)
+	}
+	for _, a := range f.apps {
+		f.deploy(a)
+	}
+}
+
+// app is a copy of the app with id, or nil if there isn't one.
+func (f *fakeMarathon) app(id string) *marathonApp {
+	f.Lock()
+	defer f.Unlock()
+	if a, ok := f.apps[id]; ok {
+		c := *a
+		return &c
+	}
+	return nil
+}
+
+func TestNewMarathonApp(t *testing.T) {
+	v := &Version{
+		ArtifactURLs: []string{"http://artifacts/web-2.tgz"},
+		Command:      []string{"./web", "-port", "$PORT0"},
+		HealthURI:    "/health",
+		MinInstances: 3,
+		Requirements: Requirements{Ports: 2, CPU: 0.5, MemoryMB: 256, DiskMB: 10},
+		deployEnv:    map[string]string{"A": "1"},
+	}
+	want := &marathonApp{
+		ID:           "/web",
+		Args:         []string{"./web", "-port", "$PORT0"},
+		URIs:         []string{"http://artifacts/web-2.tgz"},
+		CPUs:         0.5,
+		Mem:          256,
+		Disk:         10,
+		Instances:    3,
+		Ports:        []int{0, 0},
+		HealthChecks: []marathonHealthCheck{{"HTTP", "/health", 0}},
+		Env:          map[string]string{"A": "1"},
+		Labels:       map[string]string{"version": "2"},
+	}
+	if got := newMarathonApp("/web", "2", v); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	v.Requirements.SpecificPorts = []int{8080}
+	v.Strategy.Type = Recreate
+	got := newMarathonApp("/web", "2", v)
+	if !reflect.DeepEqual(got.Ports, []int{8080}) || !got.RequirePorts {
+		t.Errorf("got ports %v, requirePorts %v; want [8080], true", got.Ports, got.RequirePorts)
+	}
+	if got.Upgrade == nil || *got.Upgrade != (marathonUpgrade{0, 0}) {
+		t.Errorf("got upgrade strategy %+v; want every old task killed first", got.Upgrade)
+	}
+
+	v.Requirements = Requirements{}
+	if got := newMarathonApp("/web", "2", v); len(got.HealthChecks) != 0 {
+		t.Errorf("got health checks %+v for an app with no ports", got.HealthChecks)
+	}
+}
+
+func TestMarathonDeployScaleDelete(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	m := newMarathon(f.URL)
+	ma := &marathonApp{ID: "/web", Instances: 2, Labels: map[string]string{"version": "1"}}
+
+	if id, err := m.Deploy(ma); err != nil || id == "" {
+		t.Fatalf("creating: got deployment %q, %v", id, err)
+	}
+	if got := f.app("/web"); got == nil || got.Instances != 2 || got.Labels["version"] != "1" {
+		t.Fatalf("after creating, got %+v", got)
+	}
+
+	ma.Labels["version"] = "2"
+	if id, err := m.Deploy(ma); err != nil || id == "" {
+		t.Fatalf("updating: got deployment %q, %v", id, err)
+	}
+	if got := f.app("/web"); got.Labels["version"] != "2" {
+		t.Fatalf("after updating, got version %q", got.Labels["version"])
+	}
+
+	if id, err := m.Scale("/web", 5); err != nil || id == "" {
+		t.Fatalf("scaling: got deployment %q, %v", id, err)
+	}
+	if got := f.app("/web"); got.Instances != 5 || got.Labels["version"] != "2" {
+		t.Fatalf("after scaling, got %d instances of version %q", got.Instances, got.Labels["version"])
+	}
+
+	if err := m.Delete("/web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetApp("/web"); err != errMarathonNotFound {
+		t.Fatalf("after deleting, got %v; want %v", err, errMarathonNotFound)
+	}
+	if err := m.Delete("/web"); err != nil {
+		t.Errorf("deleting an app that doesn't exist: %v", err)
+	}
+
+	want := []string{"GET /v2/apps/web", "POST /v2/apps", "GET /v2/apps/web", "PUT /v2/apps/web",
+		"PUT /v2/apps/web", "DELETE /v2/apps/web", "GET /v2/apps/web", "DELETE /v2/apps/web"}
+	if !reflect.DeepEqual(f.requests, want) {
+		t.Errorf("got requests %v, want %v", f.requests, want)
+	}
+}
+
+func TestPutVersionDeploys(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`", "env": {"POOL": "p"}}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{"env": {"APP": "web"}}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1",
+		`{"command": ["./web"], "minInstances": 2, "healthUri": "/health", "requirements": {"Ports": 1, "CPU": 0.1}}`)
+	got := f.app("/web")
+	if got == nil {
+		t.Fatal("no app in Marathon")
+	}
+	if got.Instances != 2 || got.CPUs != 0.1 || got.Labels["version"] != "1" || len(got.HealthChecks) != 1 ||
+		!reflect.DeepEqual(got.Env, map[string]string{"POOL": "p", "APP": "web"}) {
+		t.Errorf("got %+v", got)
+	}
+	if d := state.GetVersion("p", "web", "1").Deployment; d.Status != Deploying || d.MarathonID == "" {
+		t.Errorf("got deployment %+v", d)
+	}
+	reconcilePoolDeployments("p")
+	if d := state.GetVersion("p", "web", "1").Deployment; d.Status != Healthy {
+		t.Errorf("after reconciling, got deployment %+v", d)
+	}
+}
+
+func TestMarathonErrors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", 500)
+	}))
+	defer s.Close()
+	m := newMarathon(s.URL)
+	if _, err := m.Deploy(&marathonApp{ID: "/web"}); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("deploying: got %v, want a 500", err)
+	}
+	if _, err := m.Scale("/web", 1); err == nil {
+		t.Error("scaling: got no error")
+	}
+	if err := m.Delete("/web"); err == nil {
+		t.Error("deleting: got no error")
+	}
+}
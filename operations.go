@@ -2,8 +2,17 @@ package main
 
 import (
 	"github.com/opentable/hat"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"time"
 )
 
+// The ops that change pools, apps and versions are only called for requests
+// that audited has locked the pool for, so they don't lock it themselves; the
+// ops that plan changes are called for dry runs, which it doesn't, so they do.
+
 var root = &Root{Hello: "Deployment API; Submit bugs & feature requests to https://github.com/opentable/deploy/issues"}
 
 func (r *Root) Manifest() error {
@@ -16,7 +25,6 @@ func (ps *Pools) Page() ([]string, error) {
 }
 
 func (p *Pool) Manifest(pools *Pools, name string) error {
-	println("Manifest pool "+name+" got ", p)
 	pool := state.GetPool(name)
 	if pool != nil {
 		*p = *pool
@@ -24,17 +32,96 @@ func (p *Pool) Manifest(pools *Pools, name string) error {
 	return nil
 }
 
-func (p *Pool) Write(_ *Pools, name string) error {
-	pool := state.GetPool(name)
-	if pool != nil {
-		return hat.HttpError(409, "Pool "+name+" already exists.")
+// Write creates the pool, or replaces the configuration of an existing pool,
+// keeping its apps, unless the pool comes from the config repo.
+func (p *Pool) Write(_ *Pools, name string, _ []string, h http.Header) error {
+	old := state.GetPool(name)
+	if err := old.writable(name); err != nil {
+		return err
+	}
+	p.Source = sourceAPI
+	return writePool(name, p, old, actorOf(h))
+}
+
+// Plan is what Write would do.
+func (p *Pool) Plan(_ *Pools, name string) (*Plan, error) {
+	defer state.LockPool(name)()
+	old := state.GetPool(name)
+	if err := old.writable(name); err != nil {
+		return nil, err
+	}
+	p.Source = sourceAPI
+	return planPool(name, p, old)
+}
+
+// writePool stores the pool, and redeploys its apps if its Marathon or env
+// changes. The caller must hold the pool's lock.
+func writePool(name string, p, old *Pool, actor string) error {
+	redeploy := old != nil && (p.MarathonHost != old.MarathonHost || !reflect.DeepEqual(p.Env, old.Env))
+	if redeploy {
+		for appID, a := range *old.Apps {
+			if err := a.busy(appID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := state.SetPool(name, p); err != nil {
+		return err
+	}
+	if redeploy {
+		return redeployPool(name, old.MarathonHost, actor)
 	}
-	state.SetPool(name, p)
 	return nil
 }
 
-func (as *Apps) Page() ([]string, error) {
-	return []string{}, nil
+// Delete tears down every app in the pool. Pools with running apps are only
+// deleted if ?force=true is given.
+func (p *Pool) Delete(_ *Pools, name string, _ []string, query url.Values) error {
+	if err := checkIDs(name); err != nil {
+		return err
+	}
+	pool := state.GetPool(name)
+	if pool == nil {
+		return notFound("Pool", name)
+	}
+	if err := pool.writable(name); err != nil {
+		return err
+	}
+	return deletePool(name, pool, query.Get("force") == "true")
+}
+
+// deletePool tears down every app in the pool, and forgets it. The caller
+// must hold the pool's lock.
+func deletePool(name string, pool *Pool, force bool) error {
+	if !force {
+		for appID, a := range *pool.Apps {
+			if a.running() {
+				return hat.HttpError(409, "Pool", name, "still has running apps, e.g.", appID+"; use ?force=true to delete it anyway.")
+			}
+		}
+	}
+	m := newMarathon(pool.MarathonHost)
+	for appID, a := range *pool.Apps {
+		for _, id := range a.marathonAppIDs(appID) {
+			if err := m.Delete(id); err != nil {
+				return hat.HttpError(502, "Unable to delete", id, "from Marathon:", err)
+			}
+		}
+	}
+	return state.DeletePool(name)
+}
+
+func (as *Apps) Page(_ int, p *Pool) ([]string, error) {
+	if p.Apps == nil {
+		return []string{}, nil
+	}
+	*as = *p.Apps
+	ids := make([]string, 0, len(*as))
+	for id, _ := range *as {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
 }
 
 func (a *App) Manifest(as *Apps, name string) error {
@@ -45,23 +132,355 @@ func (a *App) Manifest(as *Apps, name string) error {
 	return nil
 }
 
-func (a *App) Write(as *Apps, name string) error {
-	(*as)[name] = a
+// Write creates the app, or replaces an existing one, keeping its versions.
+// The running version is redeployed if the app's env changes.
+func (a *App) Write(as *Apps, name string, path []string, h http.Header) error {
+	poolID, _, _ := pathIDs(path)
+	old := state.GetApp(poolID, name)
+	redeploy := old != nil && !reflect.DeepEqual(a.Env, old.Env)
+	if redeploy {
+		if err := old.busy(name); err != nil {
+			return err
+		}
+	}
+	if err := state.SetApp(poolID, name, a); err != nil {
+		return err
+	}
+	if !redeploy {
+		return nil
+	}
+	if versionID, v := old.current(); v != nil {
+		return deployVersion(poolID, name, versionID, v, Event{Type: "redeploy", Actor: actorOf(h), Reason: "the app's env changed"})
+	}
 	return nil
 }
 
-func (vv *Versions) Page() ([]string, error) {
-	return []string{}, nil
+// Plan is what Write would do.
+func (a *App) Plan(as *Apps, name string, path []string) (*Plan, error) {
+	poolID, _, _ := pathIDs(path)
+	defer state.LockPool(poolID)()
+	old := state.GetApp(poolID, name)
+	if old != nil {
+		a.History, a.Versions = old.History, old.Versions
+	}
+	plan := newPlan(snapshot(poolID, name, ""), fields(a))
+	if old == nil || reflect.DeepEqual(a.Env, old.Env) {
+		return plan, nil
+	}
+	if err := old.busy(name); err != nil {
+		return nil, err
+	}
+	if versionID, v := old.current(); v != nil {
+		return plan, planDeploy(plan, poolID, state.GetPool(poolID), "", a, name, versionID, v)
+	}
+	return plan, nil
+}
+
+func (a *App) Delete(_ *Apps, name string, path []string) error {
+	poolID, _, _ := pathIDs(path)
+	if err := checkIDs(poolID, name); err != nil {
+		return err
+	}
+	app := state.GetApp(poolID, name)
+	if app == nil {
+		return notFound("App", poolID+"/"+name)
+	}
+	m := newMarathon(state.GetPool(poolID).MarathonHost)
+	for _, id := range app.marathonAppIDs(name) {
+		if err := m.Delete(id); err != nil {
+			return hat.HttpError(502, "Unable to delete", id, "from Marathon:", err)
+		}
+	}
+	return state.DeleteApp(poolID, name)
+}
+
+// DoRollback rolls the app back to r.Version, or to its last healthy version
+// if r.Version is empty.
+func (a *App) DoRollback(r *Rollback, _ *Apps, name string, path []string, _ url.Values, h http.Header) error {
+	poolID, _, _ := pathIDs(path)
+	return rollbackApp(poolID, name, r.Version, actorOf(h))
+}
+
+func (a *App) PlanRollback(r *Rollback, _ *Apps, name string, path []string) (*Plan, error) {
+	poolID, _, _ := pathIDs(path)
+	defer state.LockPool(poolID)()
+	_, target, v, err := getRollbackTarget(poolID, name, r.Version)
+	if err != nil {
+		return nil, err
+	}
+	plan := newPlan(nil, nil)
+	return plan, planDeploy(plan, poolID, state.GetPool(poolID), "", state.GetApp(poolID, name), name, target, v)
+}
+
+// Actions is the actions that can be done to the app now: it can only be
+// rolled back if it has an earlier healthy version.
+func (a *App) Actions(_ *Apps, name string, path []string) ([]string, error) {
+	poolID, _, _ := pathIDs(path)
+	if _, _, _, err := getRollbackTarget(poolID, name, ""); err != nil {
+		return []string{}, nil
+	}
+	return []string{"rollback"}, nil
+}
+
+// Page lists the app's history, newest first.
+func (h *History) Page(_ int, a *App) ([]string, error) {
+	if a.History == nil {
+		return []string{}, nil
+	}
+	*h = *a.History
+	ids := make([]string, 0, len(*h))
+	for id, _ := range *h {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+func (e *Event) Manifest(h *History, id string) error {
+	if event, ok := (*h)[id]; ok {
+		*e = *event
+	}
+	return nil
+}
+
+func (vv *Versions) Page(_ int, a *App, _ string, path []string) ([]string, error) {
+	if a.Versions == nil {
+		return []string{}, nil
+	}
+	a.annotate()
+	if pool := state.GetPool(path[1]); pool != nil {
+		a.annotateEnv(pool)
+	}
+	*vv = *a.Versions
+	ids := make([]string, 0, len(*vv))
+	for id, _ := range *vv {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
 }
 
 func (v *Version) Manifest(vs *Versions, name string) error {
+	version, ok := (*vs)[name]
+	if ok {
+		*v = *version
+	}
 	return nil
 }
 
-func (v *Version) Write(vs *Versions, name string) error {
-	if _, exists := (*vs)[name]; exists {
+func (v *Version) Write(_ *Versions, name string, path []string, h http.Header) error {
+	poolID, appID, _ := pathIDs(path)
+	if state.GetVersion(poolID, appID, name) != nil {
 		return hat.HttpError(409, name+" already exists.")
 	}
-	*(*vs)[name] = *v
+	v.Role, v.Colour, v.Scaling, v.EffectiveEnv = "", "", nil, nil
+	return deployVersion(poolID, appID, name, v, Event{Type: "deploy", Actor: actorOf(h)})
+}
+
+// Plan is what Write would do.
+func (v *Version) Plan(_ *Versions, name string, path []string) (*Plan, error) {
+	poolID, appID, _ := pathIDs(path)
+	defer state.LockPool(poolID)()
+	if state.GetVersion(poolID, appID, name) != nil {
+		return nil, hat.HttpError(409, name+" already exists.")
+	}
+	app := state.GetApp(poolID, appID)
+	if app == nil {
+		return nil, notFound("App", poolID+"/"+appID)
+	}
+	if err := recheckPolicy(poolID, appID, name, v); err != nil {
+		return nil, err
+	}
+	v.Role, v.Colour, v.Scaling, v.EffectiveEnv = "", "", nil, nil
+	plan := newPlan(nil, fields(v))
+	return plan, planDeploy(plan, poolID, state.GetPool(poolID), "", app, appID, name, v)
+}
+
+// Actions is the actions that can be done to the version now: the live
+// version can be scaled and restarted, and a blue-green candidate aborted, or
+// promoted once it is healthy.
+func (v *Version) Actions(_ *Versions, name string, path []string) ([]string, error) {
+	poolID, appID, _ := pathIDs(path)
+	actions := []string{}
+	if _, err := getLive(poolID, appID, name); err == nil {
+		actions = append(actions, "restart", "scale")
+	}
+	if _, err := getCandidate(poolID, appID, name); err == nil {
+		actions = append(actions, "abort")
+	}
+	if _, err := getPromotable(poolID, appID, name); err == nil {
+		actions = append(actions, "promote")
+	}
+	return actions, nil
+}
+
+// DoScale changes the number of instances of the live version.
+func (v *Version) DoScale(s *Scale, _ *Versions, name string, path []string, _ url.Values, h http.Header) error {
+	poolID, appID, _ := pathIDs(path)
+	return scaleVersion(poolID, appID, name, s.Instances, s.Reason, actorOf(h))
+}
+
+func (v *Version) PlanScale(s *Scale, _ *Versions, name string, path []string) (*Plan, error) {
+	poolID, appID, _ := pathIDs(path)
+	defer state.LockPool(poolID)()
+	version, err := getScalable(poolID, appID, name, s.Instances)
+	if err != nil {
+		return nil, err
+	}
+	plan := newPlan(nil, nil)
+	return plan, plan.scale(newMarathon(state.GetPool(poolID).MarathonHost), version.Deployment.appID(appID), s.Instances)
+}
+
+// DoRestart replaces every instance of the live version.
+func (v *Version) DoRestart(d *Decision, _ *Versions, name string, path []string, _ url.Values, h http.Header) error {
+	poolID, appID, _ := pathIDs(path)
+	return restartVersion(poolID, appID, name, d.Reason, actorOf(h))
+}
+
+func (v *Version) PlanRestart(d *Decision, _ *Versions, name string, path []string) (*Plan, error) {
+	poolID, appID, _ := pathIDs(path)
+	defer state.LockPool(poolID)()
+	version, err := getLive(poolID, appID, name)
+	if err != nil {
+		return nil, err
+	}
+	plan := newPlan(nil, nil)
+	plan.restart(newMarathon(state.GetPool(poolID).MarathonHost), version.Deployment.appID(appID))
+	return plan, nil
+}
+
+// DoPromote makes a blue-green candidate live.
+func (v *Version) DoPromote(d *Decision, _ *Versions, name string, path []string, _ url.Values, h http.Header) error {
+	poolID, appID, _ := pathIDs(path)
+	return promoteVersion(poolID, appID, name, d.Reason, actorOf(h))
+}
+
+func (v *Version) PlanPromote(d *Decision, _ *Versions, name string, path []string) (*Plan, error) {
+	poolID, appID, _ := pathIDs(path)
+	defer state.LockPool(poolID)()
+	version, err := getPromotable(poolID, appID, name)
+	if err != nil {
+		return nil, err
+	}
+	plan := newPlan(nil, nil)
+	return plan, plan.delete(newMarathon(state.GetPool(poolID).MarathonHost), version.Deployment.Cutover.FromMarathonAppID)
+}
+
+// DoAbort removes a blue-green candidate.
+func (v *Version) DoAbort(d *Decision, _ *Versions, name string, path []string, _ url.Values, h http.Header) error {
+	poolID, appID, _ := pathIDs(path)
+	return abortVersion(poolID, appID, name, d.Reason, actorOf(h))
+}
+
+func (v *Version) PlanAbort(d *Decision, _ *Versions, name string, path []string) (*Plan, error) {
+	poolID, appID, _ := pathIDs(path)
+	defer state.LockPool(poolID)()
+	version, err := getCandidate(poolID, appID, name)
+	if err != nil {
+		return nil, err
+	}
+	plan := newPlan(nil, nil)
+	return plan, plan.delete(newMarathon(state.GetPool(poolID).MarathonHost), version.Deployment.MarathonAppID)
+}
+
+// Delete stops the version in Marathon if it is the one running, and forgets
+// about it.
+func (v *Version) Delete(_ *Versions, name string, path []string) error {
+	poolID, appID, _ := pathIDs(path)
+	if err := checkIDs(poolID, appID, name); err != nil {
+		return err
+	}
+	version := state.GetVersion(poolID, appID, name)
+	if version == nil {
+		return notFound("Version", poolID+"/"+appID+"/"+name)
+	}
+	m := newMarathon(state.GetPool(poolID).MarathonHost)
+	id := marathonAppID(appID)
+	if version.Deployment != nil {
+		id = version.Deployment.appID(appID)
+	}
+	if app, err := m.GetApp(id); err != nil && err != errMarathonNotFound {
+		return hat.HttpError(502, "Unable to get", id, "from Marathon:", err)
+	} else if err == nil && app.Labels["version"] == name {
+		if err := m.Delete(id); err != nil {
+			return hat.HttpError(502, "Unable to delete", id, "from Marathon:", err)
+		}
+	}
+	return state.DeleteVersion(poolID, appID, name)
+}
+
+func (d *Deployment) Manifest(_ *Version, _ string, path []string) error {
+	poolID, appID, versionID := pathIDs(path)
+	if v := state.GetVersion(poolID, appID, versionID); v != nil && v.Deployment != nil {
+		*d = *v.Deployment
+	}
 	return nil
 }
+
+func (d *Drift) Manifest(_ *Pool, _ string, path []string) error {
+	poolID, _, _ := pathIDs(path)
+	if drift := state.GetDrift(poolID); drift != nil {
+		*d = *drift
+	}
+	return nil
+}
+
+// pathIDs picks the pool, app and version IDs out of a hat path like
+// [pools p apps a versions v]. IDs not present in the path are empty.
+func pathIDs(path []string) (pool, app, version string) {
+	ids := make([]string, 3)
+	for i := 1; i < len(path) && i/2 < len(ids); i += 2 {
+		ids[i/2] = path[i]
+	}
+	return ids[0], ids[1], ids[2]
+}
+
+// Page lists the audit log, newest first.
+func (al *AuditLog) Page() ([]string, error) {
+	*al = state.GetAudit()
+	ids := make([]string, 0, len(*al))
+	for id, _ := range *al {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+// Filter narrows the audit log down to the records matching ?pool=, ?app=
+// and ?actor=, made ?since= and ?until= the given RFC 3339 times.
+func (al *AuditLog) Filter(ids []string, query url.Values) ([]string, error) {
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if s := query.Get(name); s == "" {
+			continue
+		} else if parsed, err := time.Parse(time.RFC3339, s); err != nil {
+			return nil, hat.HttpError(400, name, "must be an RFC 3339 time, e.g. 2006-01-02T15:04:05Z:", err)
+		} else {
+			*t = parsed
+		}
+	}
+	filtered := []string{}
+	for _, id := range ids {
+		rec := (*al)[id]
+		if (query.Get("pool") != "" && rec.Pool != query.Get("pool")) ||
+			(query.Get("app") != "" && rec.App != query.Get("app")) ||
+			(query.Get("actor") != "" && rec.Actor != query.Get("actor")) ||
+			(!since.IsZero() && rec.At.Before(since)) ||
+			(!until.IsZero() && rec.At.After(until)) {
+			continue
+		}
+		filtered = append(filtered, id)
+	}
+	return filtered, nil
+}
+
+func (rec *AuditRecord) Manifest(al *AuditLog, id string) error {
+	if r, ok := (*al)[id]; ok {
+		*rec = *r
+	}
+	return nil
+}
+
+func notFound(kind, id string) error {
+	return hat.HttpError(404, kind, id, "does not exist.")
+}
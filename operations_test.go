@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestVersionsCannotBeChanged(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	if status, body := request(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web2"], "minInstances": 1}`); status != 409 {
+		t.Errorf("PUT of an existing version: got %d %s, want 409", status, body)
+	}
+	if status, body := request(t, s, "PATCH", "/pools/p/apps/web/versions/1", `{"minInstances": 2}`); status != 405 {
+		t.Errorf("PATCH of a version: got %d %s, want 405", status, body)
+	}
+	if status, body := request(t, s, "PATCH", "/pools/p/apps/web", `{"env": {"A": "1"}}`); status != 200 {
+		t.Errorf("PATCH of an app: got %d %s, want 200", status, body)
+	}
+}
+
+// links is the rels of the links of the resource at path.
+func links(t *testing.T, s *httptest.Server, path string) []string {
+	r := struct {
+		Links map[string]interface{} `json:"_links"`
+	}{}
+	if err := json.Unmarshal([]byte(mustRequest(t, s, "GET", path, "")), &r); err != nil {
+		t.Fatal(err)
+	}
+	rels := []string{}
+	for rel, _ := range r.Links {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	return rels
+}
+
+func TestActionLinks(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2", `{"command": ["./web"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/3", `{"command": ["./web"], "minInstances": 1, "strategy": {"type": "blue-green"}}`)
+	for path, want := range map[string][]string{
+		"/pools/p/apps/web":            {"history", "rollback", "self"},
+		"/pools/p/apps/web/versions/1": {"deployment", "self"},
+		"/pools/p/apps/web/versions/2": {"deployment", "restart", "scale", "self"},
+		"/pools/p/apps/web/versions/3": {"abort", "deployment", "self"},
+	} {
+		if got := links(t, s, path); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got links %v, want %v", path, got, want)
+		}
+	}
+	reconcilePoolDeployments("p")
+	if got, want := links(t, s, "/pools/p/apps/web/versions/3"), []string{"abort", "deployment", "promote", "self"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("healthy candidate: got links %v, want %v", got, want)
+	}
+}
+
+func TestInvalidIDsAreRejected(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	for _, c := range []struct {
+		method, path string
+		want         int
+	}{
+		{"PUT", "/pools/..", 422},
+		{"PUT", "/pools/.", 422},
+		{"PUT", "/pools/a*b", 422},
+		{"PUT", "/pools/p/apps/..", 422},
+		{"PUT", "/pools/p/apps/web/versions/..", 422},
+		{"DELETE", "/pools/..?force=true", 400},
+		{"DELETE", "/pools/p/apps/..", 400},
+		{"DELETE", "/pools/p/apps/web/versions/..", 400},
+	} {
+		body := `{"marathonHost": "` + f.URL + `", "command": ["./web"], "minInstances": 1}`
+		if status, got := request(t, s, c.method, c.path, body); status != c.want {
+			t.Errorf("%s %s: got %d %s, want %d", c.method, c.path, status, got, c.want)
+		}
+	}
+	if ids := state.GetPoolIDs(); !reflect.DeepEqual(ids, []string{"p"}) {
+		t.Errorf("got pools %v, want just p", ids)
+	}
+	if state.GetApp("p", "web") == nil {
+		t.Error("app web is gone")
+	}
+}
+
+// etag is the ETag of the resource at path.
+func etag(t *testing.T, s *httptest.Server, path string) string {
+	status, header, body := requestWithHeader(t, s, "GET", path, "", nil)
+	if status != 200 || header.Get("ETag") == "" {
+		t.Fatalf("GET %s: got %d with ETag %q: %s", path, status, header.Get("ETag"), body)
+	}
+	return header.Get("ETag")
+}
+
+func TestETagsAreStable(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`", "env": {"A": "1", "B": "2", "C": "3", "D": "4"}}`)
+	for _, app := range []string{"web", "api", "worker", "cron"} {
+		mustRequest(t, s, "PUT", "/pools/p/apps/"+app, `{"env": {"E": "5", "F": "6", "G": "7"}}`)
+	}
+	want := etag(t, s, "/pools/p")
+	for i := 0; i < 10; i++ {
+		if got := etag(t, s, "/pools/p"); got != want {
+			t.Fatalf("got ETag %s, then %s", want, got)
+		}
+	}
+	mustRequest(t, s, "PATCH", "/pools/p", `{"env": {"A": "2"}}`)
+	if got := etag(t, s, "/pools/p"); got == want {
+		t.Errorf("the ETag is still %s after a change", got)
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	pool := `{"marathonHost": "` + f.URL + `"}`
+	mustRequest(t, s, "PUT", "/pools/p", pool)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	current, app := etag(t, s, "/pools/p"), etag(t, s, "/pools/p/apps/web")
+	for _, c := range []struct {
+		method, path, body string
+		header             http.Header
+		want               int
+	}{
+		{"PUT", "/pools/p", pool, http.Header{"If-Match": {`"stale"`}}, 412},
+		{"PATCH", "/pools/p", `{"env": {"A": "1"}}`, http.Header{"If-Match": {`"stale"`}}, 412},
+		{"DELETE", "/pools/p/apps/web", "", http.Header{"If-Match": {`"stale"`}}, 412},
+		{"PUT", "/pools/q", pool, http.Header{"If-Match": {current}}, 412},
+		{"PUT", "/pools/p", pool, http.Header{"If-None-Match": {"*"}}, 412},
+		{"PUT", "/pools/p/apps/web", `{}`, http.Header{"If-None-Match": {"*"}}, 412},
+		{"PUT", "/pools/p", `{"marathonHost": "` + f.URL + `", "env": {"A": "1"}}`, http.Header{"If-Match": {current}}, 200},
+		{"PUT", "/pools/p/apps/api", `{}`, http.Header{"If-None-Match": {"*"}}, 201},
+		{"DELETE", "/pools/p/apps/web", "", http.Header{"If-Match": {app}}, 200},
+	} {
+		if status, _, body := requestWithHeader(t, s, c.method, c.path, c.body, c.header); status != c.want {
+			t.Errorf("%s %s with %v: got %d %s, want %d", c.method, c.path, c.header, status, body, c.want)
+		}
+	}
+	if p := state.GetPool("p"); p.Env["A"] != "1" || state.GetPool("q") != nil {
+		t.Errorf("got pool p with env %v, and pool q %v", p.Env, state.GetPool("q"))
+	}
+}
+
+func TestInvalidEntitiesAreRejected(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	for _, c := range []struct {
+		path, body string
+		fields     []string
+	}{
+		{"/pools/q", `{}`, []string{"marathonHost"}},
+		{"/pools/q", `{"name": "r", "marathonHost": "` + f.URL + `", "driftMode": "ignore"}`, []string{"name", "driftMode"}},
+		{"/pools/p/apps/api", `{"name": "web"}`, []string{"name"}},
+		{"/pools/p/apps/web/versions/1", `{"version": "2", "appName": "api", "command": ["./web"]}`, []string{"version", "appName"}},
+		{"/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 3, "maxInstances": 2}`, []string{"maxInstances"}},
+		{"/pools/p/apps/web/versions/1", `{"command": ["./web"], "artifactUrls": ["", "web.tgz"]}`, []string{"artifactUrls", "artifactUrls"}},
+		{"/pools/p/apps/web/versions/1", `{"command": [], "healthUri": "health", "requirements": {"CPU": -1}}`,
+			[]string{"command", "healthUri", "requirements.CPU"}},
+		{"/pools/p/apps/web/versions/1",
+			`{"command": ["./web"], "minInstances": 2, "maxInstances": 2, "autoscale": {"metricUri": "/load", "target": 1}}`,
+			[]string{"maxInstances"}},
+	} {
+		status, body := request(t, s, "PUT", c.path, c.body)
+		var e struct {
+			Errors []struct{ Field string }
+		}
+		json.Unmarshal([]byte(body), &e)
+		fields := []string{}
+		for _, fe := range e.Errors {
+			fields = append(fields, fe.Field)
+		}
+		sort.Strings(fields)
+		sort.Strings(c.fields)
+		if status != 422 || !reflect.DeepEqual(fields, c.fields) {
+			t.Errorf("PUT %s %s: got %d %s; want 422 with errors for %v", c.path, c.body, status, body, c.fields)
+		}
+	}
+	if state.GetPool("q") != nil || state.GetApp("p", "api") != nil || state.GetVersion("p", "web", "1") != nil {
+		t.Error("an invalid entity was stored")
+	}
+}
+
+func TestDeletePool(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2", `{"command": ["./web"], "minInstances": 1, "strategy": {"type": "blue-green"}}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/api", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/api/versions/1", `{"command": ["./api"], "minInstances": 1}`)
+	apps := []string{"/web", "/web-green", "/api"}
+
+	if status, body := request(t, s, "DELETE", "/pools/p", ""); status != 409 {
+		t.Errorf("got %d %s, want 409 while apps are running", status, body)
+	}
+	if state.GetPool("p") == nil {
+		t.Fatal("the pool was deleted")
+	}
+	for _, id := range apps {
+		if f.app(id) == nil {
+			t.Errorf("%s was removed from Marathon", id)
+		}
+	}
+
+	mustRequest(t, s, "DELETE", "/pools/p?force=true", "")
+	if state.GetPool("p") != nil {
+		t.Error("the pool is still there")
+	}
+	for _, id := range apps {
+		if f.app(id) != nil {
+			t.Errorf("%s is still in Marathon", id)
+		}
+	}
+}
+
+func TestDeleteVersion(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2", `{"command": ["./web", "-v2"], "minInstances": 1}`)
+	reconcilePoolDeployments("p")
+
+	mustRequest(t, s, "DELETE", "/pools/p/apps/web/versions/1", "")
+	if a := f.app("/web"); a == nil || a.Labels["version"] != "2" {
+		t.Fatalf("deleting a version that isn't live changed Marathon's app to %+v", a)
+	}
+	mustRequest(t, s, "DELETE", "/pools/p/apps/web/versions/2", "")
+	if a := f.app("/web"); a != nil {
+		t.Errorf("the live version is still in Marathon: %+v", a)
+	}
+	if state.GetVersion("p", "web", "1") != nil || state.GetVersion("p", "web", "2") != nil {
+		t.Error("the versions weren't forgotten")
+	}
+}
+
+// page is the IDs of the items on the page of the collection at path, and
+// the hrefs of its links by rel.
+func page(t *testing.T, s *httptest.Server, path, collection string) ([]string, map[string]string) {
+	var p struct {
+		Embedded map[string][]struct {
+			Links map[string]struct{ Href string } `json:"_links"`
+		} `json:"_embedded"`
+		Links map[string]struct{ Href string } `json:"_links"`
+	}
+	if err := json.Unmarshal([]byte(mustRequest(t, s, "GET", path, "")), &p); err != nil {
+		t.Fatal(err)
+	}
+	ids, links := []string{}, map[string]string{}
+	for _, item := range p.Embedded[collection] {
+		href := item.Links["self"].Href
+		ids = append(ids, href[strings.LastIndex(href, "/")+1:])
+	}
+	for rel, l := range p.Links {
+		links[rel] = l.Href
+	}
+	return ids, links
+}
+
+func TestPaging(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	all := []string{}
+	for i := 0; i < 45; i++ {
+		all = append(all, fmt.Sprintf("app%02d", i))
+	}
+	// Create them out of order.
+	for i := range all {
+		mustRequest(t, s, "PUT", "/pools/p/apps/"+all[(i*7)%len(all)], `{}`)
+	}
+	for _, c := range []struct {
+		path             string
+		ids              []string
+		prev, self, next string
+	}{
+		{"/pools/p/apps", all[:20], "", "/pools/p/apps?page=1", "/pools/p/apps?page=2"},
+		{"/pools/p/apps?page=1", all[:20], "", "/pools/p/apps?page=1", "/pools/p/apps?page=2"},
+		{"/pools/p/apps?page=2", all[20:40], "/pools/p/apps?page=1", "/pools/p/apps?page=2", "/pools/p/apps?page=3"},
+		{"/pools/p/apps?page=3", all[40:], "/pools/p/apps?page=2", "/pools/p/apps?page=3", ""},
+	} {
+		ids, links := page(t, s, c.path, "apps")
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%s: got %v, want %v", c.path, ids, c.ids)
+		}
+		if links["prev"] != c.prev || links["self"] != c.self || links["next"] != c.next {
+			t.Errorf("%s: got links %v, want prev %q, self %q and next %q", c.path, links, c.prev, c.self, c.next)
+		}
+	}
+	for _, c := range []struct {
+		path string
+		want int
+	}{
+		{"/pools/p/apps?page=4", 404},
+		{"/pools/p/apps?page=-1", 404},
+		{"/pools/p/apps?page=two", 400},
+	} {
+		if status, body := request(t, s, "GET", c.path, ""); status != c.want {
+			t.Errorf("%s: got %d %s, want %d", c.path, status, body, c.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"github.com/opentable/hat"
+	"reflect"
+)
+
+// Plan is what a PUT, PATCH or action would do, worked out without doing it:
+// how the entity would change, and what would be sent to Marathon.
+type Plan struct {
+	Diff     map[string]FieldChange `json:"diff,omitempty"`
+	Marathon []MarathonChange       `json:"marathon"`
+}
+
+// MarathonChange is one change deploy would make in a Marathon: to create,
+// update, scale, restart or delete the app with AppID. App is the definition
+// that would be sent, and Diff how its fields differ from the app running
+// now. Secrets are redacted from both.
+type MarathonChange struct {
+	Host   string                 `json:"host"`
+	Action string                 `json:"action"`
+	AppID  string                 `json:"appId"`
+	App    *marathonApp           `json:"app,omitempty"`
+	Diff   map[string]FieldChange `json:"diff,omitempty"`
+}
+
+func newPlan(before, after map[string]interface{}) *Plan {
+	p := &Plan{Marathon: []MarathonChange{}}
+	if before != nil || after != nil {
+		p.Diff = diff(before, after)
+	}
+	return p
+}
+
+// planPool is writePool, planned.
+func planPool(name string, p, old *Pool) (*Plan, error) {
+	plan := newPlan(snapshot(name, "", ""), fields(p))
+	if old == nil || (p.MarathonHost == old.MarathonHost && reflect.DeepEqual(p.Env, old.Env)) {
+		return plan, nil
+	}
+	for appID, a := range *old.Apps {
+		if err := a.busy(appID); err != nil {
+			return nil, err
+		}
+	}
+	for appID, app := range *old.Apps {
+		versionID, v := app.current()
+		if v == nil {
+			continue
+		}
+		if err := planDeploy(plan, name, p, old.MarathonHost, app, appID, versionID, v); err != nil {
+			return nil, err
+		}
+		if old.MarathonHost != p.MarathonHost {
+			if err := plan.delete(newMarathon(old.MarathonHost), v.Deployment.appID(appID)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return plan, nil
+}
+
+// planDeploy adds deployVersionFrom, as it would be with the pool and app
+// given, to plan.
+func planDeploy(plan *Plan, poolID string, pool *Pool, liveHost string, app *App, appID, versionID string, v *Version) error {
+	m := newMarathon(pool.MarathonHost)
+	steps, err := planDeployment(m, liveHost, pool, app, appID, versionID, v)
+	if err != nil {
+		return err
+	}
+	r := redactor{secretKeys(effectiveEnv(pool.Env, app.Env, v.Env)), steps.secretValues}
+	if _, current := app.current(); current != nil {
+		// The running app may have secrets the new version doesn't.
+		if p, a := state.GetPool(poolID), state.GetApp(poolID, appID); p != nil && a != nil {
+			for k, _ := range secretKeys(effectiveEnv(p.Env, a.Env, current.Env)) {
+				r.keys[k] = true
+			}
+		}
+	}
+	if err := plan.deploy(m, steps.app, r); err != nil {
+		return err
+	}
+	for _, id := range steps.remove {
+		if err := plan.delete(m, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deploy plans creating ma, or updating it if it is already running.
+func (p *Plan) deploy(m *marathon, ma *marathonApp, r redactor) error {
+	running, err := m.GetApp(ma.ID)
+	if err != nil && err != errMarathonNotFound {
+		return hat.HttpError(502, "Unable to get", ma.ID, "from Marathon:", err)
+	}
+	c := *ma
+	c.Env = r.redact(ma.Env)
+	after := fields(&c)
+	change := MarathonChange{m.URL, "create", ma.ID, &c, diff(nil, after)}
+	if running != nil {
+		running.Env = r.redactRunning(running.Env, ma.Env)
+		change.Action, change.Diff = "update", diff(only(fields(running), after), after)
+	}
+	p.Marathon = append(p.Marathon, change)
+	return nil
+}
+
+// scale plans scaling the app with id to instances.
+func (p *Plan) scale(m *marathon, id string, instances int) error {
+	running, err := m.GetApp(id)
+	if err != nil {
+		return hat.HttpError(502, "Unable to get", id, "from Marathon:", err)
+	}
+	d := map[string]FieldChange{}
+	if running.Instances != instances {
+		d["instances"] = FieldChange{running.Instances, instances}
+	}
+	p.Marathon = append(p.Marathon, MarathonChange{m.URL, "scale", id, nil, d})
+	return nil
+}
+
+func (p *Plan) restart(m *marathon, id string) {
+	p.Marathon = append(p.Marathon, MarathonChange{m.URL, "restart", id, nil, nil})
+}
+
+// delete plans deleting the app with id, if it is running and not already
+// planned to be deleted.
+func (p *Plan) delete(m *marathon, id string) error {
+	for _, c := range p.Marathon {
+		if c.Host == m.URL && c.AppID == id && c.Action == "delete" {
+			return nil
+		}
+	}
+	if _, err := m.GetApp(id); err == errMarathonNotFound {
+		return nil
+	} else if err != nil {
+		return hat.HttpError(502, "Unable to get", id, "from Marathon:", err)
+	}
+	p.Marathon = append(p.Marathon, MarathonChange{m.URL, "delete", id, nil, nil})
+	return nil
+}
+
+// only is the fields of f that are also in keys.
+func only(f, keys map[string]interface{}) map[string]interface{} {
+	o := map[string]interface{}{}
+	for k, _ := range keys {
+		if v, ok := f[k]; ok {
+			o[k] = v
+		}
+	}
+	return o
+}
+
+// redactor hides the values of env vars that are, or were, secret, and any
+// other env var that happens to have a secret value.
+type redactor struct {
+	keys   map[string]bool
+	values []string
+}
+
+func (r redactor) redact(env map[string]string) map[string]string {
+	if env == nil {
+		return nil
+	}
+	redactedEnv := make(map[string]string, len(env))
+	for k, v := range env {
+		if r.keys[k] || contains(r.values, v) {
+			v = redacted
+		}
+		redactedEnv[k] = v
+	}
+	return redactedEnv
+}
+
+// redactRunning is redact, except that secrets that differ from those in
+// the env about to be deployed say so, so that the change shows in a diff.
+func (r redactor) redactRunning(env, deploying map[string]string) map[string]string {
+	redactedEnv := r.redact(env)
+	for k, v := range redactedEnv {
+		if v == redacted && env[k] != deploying[k] {
+			redactedEnv[k] = redacted + " (differs)"
+		}
+	}
+	return redactedEnv
+}
+
+// secretKeys is the env vars that are secret references.
+func secretKeys(env map[string]string) map[string]bool {
+	keys := map[string]bool{}
+	for k, v := range env {
+		if _, _, ok, _ := parseSecretRef(v); ok {
+			keys[k] = true
+		}
+	}
+	return keys
+}
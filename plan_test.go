@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// changes is every request made of f that isn't a GET.
+func changes(f *fakeMarathon) []string {
+	f.Lock()
+	defer f.Unlock()
+	c := []string{}
+	for _, r := range f.requests {
+		if !strings.HasPrefix(r, "GET ") {
+			c = append(c, r)
+		}
+	}
+	return c
+}
+
+// poolJSON is the pool as it is stored.
+func poolJSON(t *testing.T, id string) string {
+	data, err := json.Marshal(state.GetPool(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDryRunsChangeNothing(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	remote, _ := useTestRepo(t)
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 2, "maxInstances": 4}`)
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2", `{"command": ["./web", "-v2"], "minInstances": 2, "maxInstances": 4}`)
+	reconcilePoolDeployments("p")
+
+	before, marathon, files, audit := poolJSON(t, "p"), changes(f), remoteFiles(t, remote), len(state.GetAudit())
+	for _, r := range []struct{ method, path, body string }{
+		{"PUT", "/pools/p", `{"marathonHost": "` + f.URL + `", "env": {"A": "1"}}`},
+		{"PATCH", "/pools/p", `{"env": {"A": "1"}}`},
+		{"PUT", "/pools/p/apps/web", `{"env": {"A": "1"}}`},
+		{"PATCH", "/pools/p/apps/web", `{"env": {"A": "1"}}`},
+		{"PUT", "/pools/p/apps/api", `{}`},
+		{"PUT", "/pools/p/apps/web/versions/3", `{"command": ["./web", "-v3"], "minInstances": 2, "maxInstances": 4}`},
+		{"POST", "/pools/p/apps/web/rollback", `{}`},
+		{"POST", "/pools/p/apps/web/versions/2/scale", `{"instances": 3}`},
+		{"POST", "/pools/p/apps/web/versions/2/restart", `{}`},
+	} {
+		status, body := request(t, s, r.method, r.path+"?dryRun=true", r.body)
+		if status != 200 || !strings.Contains(body, `"marathon"`) {
+			t.Errorf("%s %s: got %d %s; want a plan", r.method, r.path, status, body)
+		}
+	}
+	if after := poolJSON(t, "p"); after != before {
+		t.Errorf("the pool changed from %s to %s", before, after)
+	}
+	if got := changes(f); !reflect.DeepEqual(got, marathon) {
+		t.Errorf("Marathon got %v", got[len(marathon):])
+	}
+	if got := remoteFiles(t, remote); got != files {
+		t.Errorf("the state repo changed from %s to %s", files, got)
+	}
+	if got := len(state.GetAudit()); got != audit {
+		t.Errorf("got %d audit records, want %d", got, audit)
+	}
+}
+
+func TestDryRunsFailLikeRealRequests(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 2, "maxInstances": 4}`)
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2",
+		`{"command": ["./web", "-v2"], "minInstances": 2, "maxInstances": 4, "strategy": {"type": "blue-green"}}`)
+
+	for _, r := range []struct {
+		method, path, body string
+		want               int
+	}{
+		// Version 2 is a blue-green candidate.
+		{"PUT", "/pools/p/apps/web/versions/3", `{"command": ["./web"], "minInstances": 2, "maxInstances": 4}`, 409},
+		{"POST", "/pools/p/apps/web/rollback", `{"version": "1"}`, 409},
+		{"PUT", "/pools/p/apps/web/versions/3", `{"command": ["./web"], "minInstances": 5, "maxInstances": 4}`, 422},
+		{"PUT", "/pools/p/apps/api", `{"env": {"S": "secret://missing#key"}}`, 422},
+		{"POST", "/pools/p/apps/web/versions/1/scale", `{"instances": 5}`, 422},
+	} {
+		dryStatus, dryBody := request(t, s, r.method, r.path+"?dryRun=true", r.body)
+		status, body := request(t, s, r.method, r.path, r.body)
+		if dryStatus != r.want || status != r.want || dryBody != body {
+			t.Errorf("%s %s: got %d %s dry, and %d %s for real; want %d for both", r.method, r.path, dryStatus, dryBody, status, body, r.want)
+		}
+	}
+}
+
+func TestDryRunDeleteIsRefused(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	for _, path := range []string{"/pools/p/apps/web", "/pools/p"} {
+		if status, body := request(t, s, "DELETE", path+"?dryRun=true", ""); status != 400 {
+			t.Errorf("DELETE %s?dryRun=true: got %d %s, want 400", path, status, body)
+		}
+	}
+	if state.GetApp("p", "web") == nil {
+		t.Error("the app was deleted")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opentable/hat"
+	"strings"
+)
+
+// Policy limits the versions that may be deployed to a pool. Zero values
+// don't limit anything. The Max fields are per instance, and the MaxTotal
+// fields for every app in the pool, counting each at its maxInstances.
+// MinInstances is the least minInstances a version may have, e.g. 2 in
+// production pools.
+type Policy struct {
+	MaxCPU              float64  `json:"maxCpu,omitempty"`
+	MaxMemoryMB         float64  `json:"maxMemoryMB,omitempty"`
+	MaxDiskMB           float64  `json:"maxDiskMB,omitempty"`
+	MaxTotalCPU         float64  `json:"maxTotalCpu,omitempty"`
+	MaxTotalMemoryMB    float64  `json:"maxTotalMemoryMB,omitempty"`
+	MaxTotalDiskMB      float64  `json:"maxTotalDiskMB,omitempty"`
+	ArtifactURLPrefixes []string `json:"artifactUrlPrefixes,omitempty"`
+	RequiredTags        []string `json:"requiredTags,omitempty"`
+	MinInstances        int      `json:"minInstances,omitempty"`
+}
+
+func validatePolicy(ve *hat.ValidationError, p Policy) {
+	for field, v := range map[string]float64{
+		"maxCpu": p.MaxCPU, "maxMemoryMB": p.MaxMemoryMB, "maxDiskMB": p.MaxDiskMB,
+		"maxTotalCpu": p.MaxTotalCPU, "maxTotalMemoryMB": p.MaxTotalMemoryMB, "maxTotalDiskMB": p.MaxTotalDiskMB,
+	} {
+		if v < 0 {
+			ve.Add("policy."+field, "must not be negative")
+		}
+	}
+	if p.MinInstances < 0 {
+		ve.Add("policy.minInstances", "must not be negative")
+	}
+}
+
+// checkPolicy adds to ve every way in which v, to be deployed as appID, breaks
+// the policy of the pool.
+func checkPolicy(ve *hat.ValidationError, pool *Pool, poolID, appID string, v *Version) {
+	p, r := pool.Policy, v.Requirements
+	broken := func(field string, args ...interface{}) {
+		ve.Add(field, fmt.Sprint(args...)+", which breaks the policy of pool "+poolID)
+	}
+	if p.MaxCPU != 0 && r.CPU > p.MaxCPU {
+		broken("requirements.CPU", "is over maxCpu of ", p.MaxCPU)
+	}
+	if p.MaxMemoryMB != 0 && r.MemoryMB > p.MaxMemoryMB {
+		broken("requirements.MemoryMB", "is over maxMemoryMB of ", p.MaxMemoryMB)
+	}
+	if p.MaxDiskMB != 0 && r.DiskMB > p.MaxDiskMB {
+		broken("requirements.DiskMB", "is over maxDiskMB of ", p.MaxDiskMB)
+	}
+	if v.MinInstances < p.MinInstances {
+		broken("minInstances", "is under minInstances of ", p.MinInstances)
+	}
+	if len(p.ArtifactURLPrefixes) != 0 {
+		for _, a := range v.ArtifactURLs {
+			if !hasAnyPrefix(a, p.ArtifactURLPrefixes) {
+				broken("artifactUrls", quot(a), " does not start with any of artifactUrlPrefixes ", strings.Join(p.ArtifactURLPrefixes, ", "))
+			}
+		}
+	}
+	for _, t := range p.RequiredTags {
+		if !contains(v.Tags.Tags, t) {
+			broken("tags", "lack ", quot(t), ", one of requiredTags")
+		}
+	}
+	total := v.footprint()
+	for id, a := range *pool.Apps {
+		if _, live := a.current(); live != nil && id != appID {
+			total = total.plus(live.footprint())
+		}
+	}
+	if p.MaxTotalCPU != 0 && total.CPU > p.MaxTotalCPU {
+		broken("requirements.CPU", "brings the pool's total to ", total.CPU, ", over maxTotalCpu of ", p.MaxTotalCPU)
+	}
+	if p.MaxTotalMemoryMB != 0 && total.MemoryMB > p.MaxTotalMemoryMB {
+		broken("requirements.MemoryMB", "brings the pool's total to ", total.MemoryMB, ", over maxTotalMemoryMB of ", p.MaxTotalMemoryMB)
+	}
+	if p.MaxTotalDiskMB != 0 && total.DiskMB > p.MaxTotalDiskMB {
+		broken("requirements.DiskMB", "brings the pool's total to ", total.DiskMB, ", over maxTotalDiskMB of ", p.MaxTotalDiskMB)
+	}
+}
+
+// recheckPolicy checks v against the policy of the pool again, for a dry run.
+// audited doesn't lock the pool for dry runs, so Validate checks them before
+// Plan locks it, and another version may since have used up what was left of
+// the pool's totals. The caller must hold the pool's lock.
+func recheckPolicy(poolID, appID, versionID string, v *Version) error {
+	pool := state.GetPool(poolID)
+	if pool == nil {
+		return nil
+	}
+	ve := hat.NewValidationError("Version", versionID, "is invalid.")
+	checkPolicy(ve, pool, poolID, appID, v)
+	return ve.OrNil()
+}
+
+// footprint is the resources the version uses at its most instances.
+func (v *Version) footprint() Requirements {
+	n := float64(v.MinInstances)
+	if v.MaxInstances > v.MinInstances {
+		n = float64(v.MaxInstances)
+	}
+	r := v.Requirements
+	return Requirements{CPU: r.CPU * n, MemoryMB: r.MemoryMB * n, DiskMB: r.DiskMB * n}
+}
+
+func (r Requirements) plus(o Requirements) Requirements {
+	return Requirements{CPU: r.CPU + o.CPU, MemoryMB: r.MemoryMB + o.MemoryMB, DiskMB: r.DiskMB + o.DiskMB}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentPutsKeepWithinPolicyTotals(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`", "policy": {"maxTotalCpu": 1}}`)
+	puts := []func(){}
+	var lock sync.Mutex
+	deployed := 0
+	for i := 0; i < 8; i++ {
+		app := fmt.Sprintf("app%d", i)
+		mustRequest(t, s, "PUT", "/pools/p/apps/"+app, `{}`)
+		puts = append(puts, func() {
+			status, body := request(t, s, "PUT", "/pools/p/apps/"+app+"/versions/1",
+				`{"command": ["./app"], "minInstances": 1, "requirements": {"CPU": 1}}`)
+			if status == 201 {
+				lock.Lock()
+				deployed++
+				lock.Unlock()
+			} else if status != 422 {
+				t.Errorf("PUT %s: %d %s", app, status, body)
+			}
+		})
+	}
+	parallel(puts...)
+	if deployed != 1 {
+		t.Errorf("%d versions were deployed, want 1 within maxTotalCpu", deployed)
+	}
+}
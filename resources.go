@@ -1,12 +1,15 @@
 package main
 
+import "time"
+
 type Tags struct {
 	Tags []string `json:"tags"`
 }
 
 type Root struct {
-	Hello string `json:"hello"`
-	Pools *Pools `hat:"embed()"`
+	Hello string    `json:"hello"`
+	Pools *Pools    `hat:"embed()"`
+	Audit *AuditLog `json:"-" hat:"link(); page(1,20)"`
 }
 
 type Pools map[string]*Pool
@@ -15,32 +18,85 @@ type Pool struct {
 	Name         string            `json:"name"`
 	MarathonHost string            `json:"marathonHost"`
 	Env          map[string]string `json:"env"`
-	Apps         *Apps             `hat:"embed()"`
+	Policy       Policy            `json:"policy"`
+	Source       string            `json:"source"`
+	DriftMode    DriftMode         `json:"driftMode"`
+	Apps         *Apps             `json:"-" hat:"embed(); page(1,20)"`
+	Drift        *Drift            `json:"-" hat:"link()"`
 	Tags
 }
 
 type Apps map[string]*App
 
 type App struct {
-	Name     string `json:"name"`
-	Versions *Versions
+	Name     string            `json:"name"`
+	Env      map[string]string `json:"env"`
+	Versions *Versions         `json:"-" hat:"embed(); page(1,20); immutable()"`
+	History  *History          `json:"-" hat:"link(); page(1,20)"`
 	Tags
 }
 
+// History is every event of an app, by ID. IDs sort in the order the events
+// happened.
+type History map[string]*Event
+
+// Event is something that happened to an app: a version was deployed,
+// redeployed or rolled back to, or deploy was asked to scale, restart,
+// promote or abort one. Events that deploy a version also have the
+// outcome of the deployment, and when it ended, once it has.
+type Event struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	Version   string           `json:"version"`
+	From      string           `json:"from,omitempty"`
+	Actor     string           `json:"actor"`
+	Strategy  string           `json:"strategy,omitempty"`
+	Reason    string           `json:"reason,omitempty"`
+	Instances int              `json:"instances,omitempty"`
+	At        time.Time        `json:"at"`
+	EndedAt   *time.Time       `json:"endedAt,omitempty"`
+	Outcome   DeploymentStatus `json:"outcome,omitempty"`
+}
+
+// Rollback is the payload of an app's rollback action. Version is optional.
+type Rollback struct {
+	Version string `json:"version"`
+}
+
 type Versions map[string]*Version
 
 type Version struct {
-	AppName      string       `json:"appName"`
-	Version      string       `json:"version"`
-	ArtifactURLs []string     `json:"artifactUrls"`
-	Command      []string     `json:"command"`
-	HealthURI    string       `json:"healthUri"`
-	MinInstances int          `json:"minInstances"`
-	MaxInstances int          `json:"maxInstances"`
-	Requirements Requirements `json:"requirements"`
+	AppName      string            `json:"appName"`
+	Version      string            `json:"version"`
+	ArtifactURLs []string          `json:"artifactUrls"`
+	Command      []string          `json:"command"`
+	HealthURI    string            `json:"healthUri"`
+	MinInstances int               `json:"minInstances"`
+	MaxInstances int               `json:"maxInstances"`
+	Requirements Requirements      `json:"requirements"`
+	Env          map[string]string `json:"env"`
+	EffectiveEnv map[string]string `json:"effectiveEnv,omitempty"` // Not stored; see App.annotateEnv.
+	deployEnv    map[string]string // EffectiveEnv with secrets resolved; never stored or served.
+	Strategy     Strategy          `json:"strategy"`
+	Autoscale    *Autoscale        `json:"autoscale,omitempty"`
+	Role         string            `json:"role,omitempty"`    // Not stored; see App.annotate.
+	Colour       string            `json:"colour,omitempty"`  // Not stored; see App.annotate.
+	Scaling      *Scaling          `json:"scaling,omitempty"` // Not stored; see App.annotate.
+	Deployment   *Deployment       `json:"-" hat:"link()"`
 	Tags
 }
 
+// Decision is the payload of a version's promote, abort and restart actions.
+type Decision struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Scale is the payload of a version's scale action.
+type Scale struct {
+	Instances int    `json:"instances"`
+	Reason    string `json:"reason,omitempty"`
+}
+
 type Requirements struct {
 	Ports         int
 	SpecificPorts []int
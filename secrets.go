@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// secretScheme prefixes env values that are references to secrets, e.g.
+// secret://db/prod/password is the password key of the secret at db/prod.
+// References are stored and served as they are; they are only resolved
+// when a version is sent to Marathon.
+const secretScheme = "secret://"
+
+// redacted replaces secret values in anything that might be served.
+const redacted = "[redacted]"
+
+// SecretProvider looks up the value of key in the secret at path.
+type SecretProvider interface {
+	Secret(path, key string) (string, error)
+}
+
+var secrets SecretProvider
+
+// fileSecrets is a SecretProvider that keeps each secret as a JSON object of
+// keys to values, in {dir}/{path}.json.
+type fileSecrets struct {
+	dir string
+}
+
+func (f fileSecrets) Secret(p, key string) (string, error) {
+	values := map[string]string{}
+	if data, err := ioutil.ReadFile(filepath.Join(f.dir, filepath.FromSlash(p)+".json")); err != nil {
+		return "", errors.New("unable to read secret " + p + ": " + err.Error())
+	} else if err := json.Unmarshal(data, &values); err != nil {
+		return "", errors.New("unable to read secret " + p + ": " + err.Error())
+	}
+	if v, ok := values[key]; ok {
+		return v, nil
+	}
+	return "", errors.New("secret " + p + " has no key " + key)
+}
+
+// parseSecretRef splits a secret reference into its path and key. It returns
+// false if value isn't a reference; err is set if it is a bad one.
+func parseSecretRef(value string) (p, key string, ok bool, err error) {
+	if !strings.HasPrefix(value, secretScheme) {
+		return "", "", false, nil
+	}
+	ref := strings.TrimPrefix(value, secretScheme)
+	i := strings.LastIndex(ref, "/")
+	if i < 1 || i == len(ref)-1 {
+		return "", "", true, errors.New("must be like " + secretScheme + "{path}/{key}")
+	}
+	if p, key = ref[:i], ref[i+1:]; path.Clean("/"+p) != "/"+p {
+		return "", "", true, errors.New("has a path that is not clean")
+	}
+	return p, key, true, nil
+}
+
+// resolveSecrets returns env with every secret reference replaced by its
+// value, and the values that were secret, for redaction.
+func resolveSecrets(env map[string]string) (map[string]string, []string, error) {
+	resolved, values := map[string]string{}, []string{}
+	for k, v := range env {
+		p, key, ok, err := parseSecretRef(v)
+		if err != nil {
+			return nil, nil, errors.New("env " + k + " " + err.Error())
+		} else if ok {
+			if v, err = secrets.Secret(p, key); err != nil {
+				return nil, nil, errors.New("env " + k + ": " + err.Error())
+			}
+			values = append(values, v)
+		}
+		resolved[k] = v
+	}
+	return resolved, values, nil
+}
+
+// redact returns err with every secret value in its message redacted, e.g.
+// for errors from Marathon that quote the app it was sent.
+func redact(err error, values []string) error {
+	if err == nil || len(values) == 0 {
+		return err
+	}
+	message := err.Error()
+	for _, v := range values {
+		if v != "" {
+			message = strings.Replace(message, v, redacted, -1)
+		}
+	}
+	return errors.New(message)
+}
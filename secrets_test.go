@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSecret = "hunter2-s3cr3t"
+
+// useTestSecrets has secrets read from a directory with one secret in it,
+// db/prod, whose password is testSecret.
+func useTestSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "db"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "db", "prod.json"), []byte(`{"password": "`+testSecret+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := secrets
+	secrets = fileSecrets{dir}
+	t.Cleanup(func() { secrets = old })
+}
+
+func TestSecretsAreResolvedForMarathonOnly(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	remote, _ := useTestRepo(t)
+	useTestSecrets(t)
+	responses := []string{
+		mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`),
+		mustRequest(t, s, "PUT", "/pools/p/apps/web", `{"env": {"DB_PASSWORD": "secret://db/prod/password"}}`),
+		mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`),
+	}
+	if got := f.app("/web").Env["DB_PASSWORD"]; got != testSecret {
+		t.Errorf("Marathon got DB_PASSWORD %q, want the secret's value", got)
+	}
+	reconcilePoolDeployments("p")
+	responses = append(responses,
+		mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2?dryRun=true", `{"command": ["./web", "-v2"], "minInstances": 1}`),
+		mustRequest(t, s, "PUT", "/pools/p/apps/web?dryRun=true", `{"env": {"DB_PASSWORD": "secret://db/prod/password", "A": "1"}}`),
+		mustRequest(t, s, "GET", "/pools/p", ""),
+		mustRequest(t, s, "GET", "/pools/p/apps/web", ""),
+		mustRequest(t, s, "GET", "/pools/p/apps/web/versions/1", ""),
+		mustRequest(t, s, "GET", "/pools/p/apps/web/history", ""),
+		mustRequest(t, s, "GET", "/audit", ""),
+	)
+	audit, err := json.Marshal(state.GetAudit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses = append(responses, string(audit))
+	for _, r := range responses {
+		if strings.Contains(r, testSecret) {
+			t.Errorf("the secret's value is in %s", r)
+		}
+	}
+	if !strings.Contains(responses[3], redacted) {
+		t.Errorf("the plan doesn't redact the secret: %s", responses[3])
+	}
+	out, err := exec.Command("git", "--git-dir", remote, "log", "--all", "--patch").CombinedOutput()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	if !strings.Contains(string(out), "secret://db/prod/password") || strings.Contains(string(out), testSecret) {
+		t.Errorf("the state repo has the secret's value, or not its reference:\n%s", out)
+	}
+}
+
+func TestUnresolvableSecretsAreRejected(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	useTestSecrets(t)
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	for _, ref := range []string{"secret://db/staging/password", "secret://db/prod/username", "secret://password"} {
+		body := `{"command": ["./web"], "minInstances": 1, "env": {"DB_PASSWORD": "` + ref + `"}}`
+		if status, resp := request(t, s, "PUT", "/pools/p/apps/web/versions/1", body); status != 422 {
+			t.Errorf("%s: got %d %s, want 422", ref, status, resp)
+		}
+	}
+	if state.GetVersion("p", "web", "1") != nil || f.app("/web") != nil {
+		t.Error("a version with unresolvable secrets was deployed")
+	}
+}
+
+func TestMarathonErrorsAreRedacted(t *testing.T) {
+	// This Marathon refuses every app, quoting it back.
+	m := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.WriteHeader(404)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(422)
+		w.Write(body)
+	}))
+	defer m.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	useTestSecrets(t)
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+m.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{"env": {"DB_PASSWORD": "secret://db/prod/password"}}`)
+	status, body := request(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`)
+	if status != 502 || strings.Contains(body, testSecret) || !strings.Contains(body, redacted) {
+		t.Errorf("got %d %s; want 502, with the secret's value redacted", status, body)
+	}
+	audit, _ := json.Marshal(state.GetAudit())
+	if strings.Contains(string(audit), testSecret) {
+		t.Errorf("the secret's value is in the audit log: %s", audit)
+	}
+}
@@ -1,32 +1,607 @@
 package main
 
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// State is safe for concurrent use. Getters return copies, so callers never
+// share maps with writers. Changes to a pool should be made while holding
+// that pool's lock (see LockPool), so that changes to different pools don't
+// wait for each other.
 type State struct {
-	pools Pools
+	sync.RWMutex // Guards pools, poolLocks and auditing.
+	pools        Pools
+	poolLocks    map[string]*sync.Mutex
+	auditing     map[string]*AuditRecord // The request holding each pool's lock, if any.
+	audit        AuditLog
+	drift        map[string]*Drift // Not persisted; see reconcilePoolDrift.
+	repo         *gitRepo
+}
+
+var state = State{pools: Pools{}, poolLocks: map[string]*sync.Mutex{}, auditing: map[string]*AuditRecord{},
+	audit: AuditLog{}, drift: map[string]*Drift{}}
+
+// The state repo holds one file per entity:
+//
+//	pools/{pool}/pool.json
+//	pools/{pool}/apps/{app}/app.json
+//	pools/{pool}/apps/{app}/versions/{version}.json
+//	pools/{pool}/apps/{app}/deployments/{version}.json
+//	pools/{pool}/apps/{app}/history/{event}.json
+//	audit/{id}.json
+//
+// The file funcs refuse IDs that could reach outside an entity's directory,
+// e.g. "..", so that a bad ID can't overwrite or delete other entities.
+const (
+	poolPath       = "pools/%s/pool.json"
+	appPath        = "pools/%s/apps/%s/app.json"
+	versionPath    = "pools/%s/apps/%s/versions/%s.json"
+	deploymentPath = "pools/%s/apps/%s/deployments/%s.json"
+	eventPath      = "pools/%s/apps/%s/history/%s.json"
+	auditPath      = "audit/%s.json"
+)
+
+func poolFile(pool string) (string, error) {
+	return stateFile(poolPath, pool)
+}
+
+func appFile(pool, app string) (string, error) {
+	return stateFile(appPath, pool, app)
+}
+
+func versionFile(pool, app, version string) (string, error) {
+	return stateFile(versionPath, pool, app, version)
+}
+
+func deploymentFile(pool, app, version string) (string, error) {
+	return stateFile(deploymentPath, pool, app, version)
+}
+
+func eventFile(pool, app, id string) (string, error) {
+	return stateFile(eventPath, pool, app, id)
+}
+
+func auditFile(id string) (string, error) {
+	return stateFile(auditPath, id)
+}
+
+// stateFile is path with ids filled in, once they are checked.
+func stateFile(path string, ids ...string) (string, error) {
+	if err := checkIDs(ids...); err != nil {
+		return "", err
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return fmt.Sprintf(path, args...), nil
 }
 
-var state = State{Pools{}}
+// Load rebuilds the state from the working copy of the state repo, which
+// from then on is where every change is persisted.
+func (s *State) Load(repo *gitRepo) error {
+	s.Lock()
+	defer s.Unlock()
+	s.repo = repo
+	s.pools = Pools{}
+	poolFiles, err := repo.Glob(fmt.Sprintf(poolPath, "*"))
+	if err != nil {
+		return err
+	}
+	for _, pf := range poolFiles {
+		poolID := strings.Split(pf, "/")[1]
+		p := &Pool{}
+		if err := repo.ReadJSON(pf, p); err != nil {
+			return err
+		}
+		p.Apps = &Apps{}
+		s.pools[poolID] = p
+		appFiles, err := repo.Glob(fmt.Sprintf(appPath, poolID, "*"))
+		if err != nil {
+			return err
+		}
+		for _, af := range appFiles {
+			appID := strings.Split(af, "/")[3]
+			a := &App{}
+			if err := repo.ReadJSON(af, a); err != nil {
+				return err
+			}
+			a.Versions, a.History = &Versions{}, &History{}
+			(*p.Apps)[appID] = a
+			eventFiles, err := repo.Glob(fmt.Sprintf(eventPath, poolID, appID, "*"))
+			if err != nil {
+				return err
+			}
+			for _, ef := range eventFiles {
+				e := &Event{}
+				if err := repo.ReadJSON(ef, e); err != nil {
+					return err
+				}
+				(*a.History)[e.ID] = e
+			}
+			versionFiles, err := repo.Glob(fmt.Sprintf(versionPath, poolID, appID, "*"))
+			if err != nil {
+				return err
+			}
+			for _, vf := range versionFiles {
+				versionID := strings.TrimSuffix(path.Base(vf), ".json")
+				v := &Version{}
+				if err := repo.ReadJSON(vf, v); err != nil {
+					return err
+				}
+				if df := fmt.Sprintf(deploymentPath, poolID, appID, versionID); repo.Exists(df) {
+					v.Deployment = &Deployment{}
+					if err := repo.ReadJSON(df, v.Deployment); err != nil {
+						return err
+					}
+				}
+				(*a.Versions)[versionID] = v
+			}
+		}
+	}
+	s.audit = AuditLog{}
+	auditFiles, err := repo.Glob(fmt.Sprintf(auditPath, "*"))
+	if err != nil {
+		return err
+	}
+	for _, af := range auditFiles {
+		rec := &AuditRecord{}
+		if err := repo.ReadJSON(af, rec); err != nil {
+			return err
+		}
+		s.audit[rec.ID] = rec
+	}
+	return nil
+}
+
+// LockPool serialises changes to the pool with id, and returns the func that
+// unlocks it. Use it around any check-then-change of a pool, e.g.:
+//
+//	defer state.LockPool(poolID)()
+func (s *State) LockPool(id string) (unlock func()) {
+	s.Lock()
+	l, ok := s.poolLocks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.poolLocks[id] = l
+	}
+	s.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// LockPoolFor is LockPool, for the request rec records. Until the pool is
+// unlocked, changes to it are committed as the request's actor, with its
+// details as trailers.
+func (s *State) LockPoolFor(rec *AuditRecord) (unlock func()) {
+	unlockPool := s.LockPool(rec.Pool)
+	s.Lock()
+	s.auditing[rec.Pool] = rec
+	s.Unlock()
+	return func() {
+		s.Lock()
+		delete(s.auditing, rec.Pool)
+		s.Unlock()
+		unlockPool()
+	}
+}
 
 func (s *State) GetPool(id string) *Pool {
-	p, ok := s.pools[id]
-	if ok {
-		return p
+	s.RLock()
+	defer s.RUnlock()
+	if p, ok := s.pools[id]; ok {
+		return p.clone()
 	}
 	return nil
 }
 
-func (s *State) SetPool(id string, p *Pool) {
-	if p.Apps == nil {
-		p.Apps = &Apps{}
+func (s *State) GetApp(poolID, id string) *App {
+	s.RLock()
+	defer s.RUnlock()
+	if a := s.app(poolID, id); a != nil {
+		return a.clone()
 	}
-	s.pools[id] = p
+	return nil
+}
+
+func (s *State) GetVersion(poolID, appID, id string) *Version {
+	s.RLock()
+	defer s.RUnlock()
+	if v := s.version(poolID, appID, id); v != nil {
+		return v.clone()
+	}
+	return nil
+}
+
+// GetAudit returns every audit record. Records are never changed once they
+// are added, so they are shared with the copy.
+func (s *State) GetAudit() AuditLog {
+	s.RLock()
+	defer s.RUnlock()
+	audit := make(AuditLog, len(s.audit))
+	for id, rec := range s.audit {
+		audit[id] = rec
+	}
+	return audit
+}
+
+// GetDrift returns what the pool's last reconcile found, or nil if it has not
+// been reconciled yet.
+func (s *State) GetDrift(poolID string) *Drift {
+	s.RLock()
+	defer s.RUnlock()
+	if d, ok := s.drift[poolID]; ok {
+		c := *d
+		c.Problems = append([]DriftProblem{}, d.Problems...)
+		return &c
+	}
+	return nil
 }
 
 func (s *State) GetPoolIDs() []string {
+	s.RLock()
+	defer s.RUnlock()
 	ids := make([]string, len(s.pools))
 	i := 0
 	for id, _ := range s.pools {
 		ids[i] = id
 		i++
 	}
+	sort.Strings(ids)
 	return ids
 }
+
+// The Set, Add and Delete methods commit each change before making it in
+// memory, so that a change that can't be committed is lost altogether.
+
+func (s *State) SetPool(id string, p *Pool) error {
+	f, err := poolFile(id)
+	if err != nil {
+		return err
+	}
+	if err := s.commit(id, "Set pool "+id, change{f, p}); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if old, ok := s.pools[id]; ok && p.Apps == nil {
+		p.Apps = old.Apps
+	}
+	if p.Apps == nil {
+		p.Apps = &Apps{}
+	}
+	s.pools[id] = p
+	return nil
+}
+
+func (s *State) SetApp(poolID, id string, a *App) error {
+	f, err := appFile(poolID, id)
+	if err != nil {
+		return err
+	}
+	if s.GetPool(poolID) == nil {
+		return notFound("Pool", poolID)
+	}
+	if err := s.commit(poolID, "Set app "+poolID+"/"+id, change{f, a}); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	p := s.pools[poolID]
+	// History is only ever added to by deploy itself.
+	a.History = nil
+	if old, ok := (*p.Apps)[id]; ok {
+		a.History = old.History
+		if a.Versions == nil {
+			a.Versions = old.Versions
+		}
+	}
+	if a.Versions == nil {
+		a.Versions = &Versions{}
+	}
+	if a.History == nil {
+		a.History = &History{}
+	}
+	(*p.Apps)[id] = a
+	return nil
+}
+
+func (s *State) SetVersion(poolID, appID, id string, v *Version) error {
+	vf, err := versionFile(poolID, appID, id)
+	if err != nil {
+		return err
+	}
+	df, err := deploymentFile(poolID, appID, id)
+	if err != nil {
+		return err
+	}
+	if s.GetApp(poolID, appID) == nil {
+		return notFound("App", poolID+"/"+appID)
+	}
+	changes := []change{{vf, v}}
+	if v.Deployment != nil {
+		changes = append(changes, change{df, v.Deployment})
+	}
+	if err := s.commit(poolID, "Set version "+poolID+"/"+appID+"/"+id, changes...); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	(*s.app(poolID, appID).Versions)[id] = v
+	return nil
+}
+
+// AddEvent records e in the history of an existing app, giving it an ID if
+// it doesn't have one.
+func (s *State) AddEvent(poolID, appID string, e *Event) error {
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	f, err := eventFile(poolID, appID, e.ID)
+	if err != nil {
+		return err
+	}
+	if s.GetApp(poolID, appID) == nil {
+		return notFound("App", poolID+"/"+appID)
+	}
+	if err := s.commit(poolID, e.Type+" "+poolID+"/"+appID+" to "+e.Version, change{f, e}); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	(*s.app(poolID, appID).History)[e.ID] = e
+	return nil
+}
+
+// AddAuditRecord records a change in the audit log, committed as the actor
+// that made it.
+func (s *State) AddAuditRecord(rec *AuditRecord) error {
+	f, err := auditFile(rec.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.commitAs(rec.commitAuthor(), rec.commitMessage(), change{f, rec}); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.audit[rec.ID] = rec
+	return nil
+}
+
+// SetDrift records what a reconcile of the pool found. Drift is only an
+// observation, so it is kept in memory rather than committed.
+func (s *State) SetDrift(poolID string, d *Drift) {
+	s.Lock()
+	if _, ok := s.pools[poolID]; ok {
+		s.drift[poolID] = d
+	}
+	s.Unlock()
+}
+
+// SetDeployment persists the deployment status of an existing version, and
+// the outcome of the event that started the deployment.
+func (s *State) SetDeployment(poolID, appID, versionID string, d *Deployment) error {
+	f, err := deploymentFile(poolID, appID, versionID)
+	if err != nil {
+		return err
+	}
+	a := s.GetApp(poolID, appID)
+	if a == nil || (*a.Versions)[versionID] == nil {
+		return notFound("Version", poolID+"/"+appID+"/"+versionID)
+	}
+	changes := []change{{f, d}}
+	var ended *Event
+	if e, ok := (*a.History)[d.Event]; ok && e.EndedAt == nil {
+		// Events keep the first outcome they settle on, e.g. healthy, even
+		// if the version is superseded later.
+		c := *e
+		ended = &c
+		ended.Outcome = d.Status
+		if d.Settled() {
+			at := d.Transitions[len(d.Transitions)-1].At
+			ended.EndedAt = &at
+		}
+		ef, err := eventFile(poolID, appID, ended.ID)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change{ef, ended})
+	}
+	if err := s.commit(poolID, "Deployment of "+poolID+"/"+appID+"/"+versionID+" is "+string(d.Status), changes...); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.version(poolID, appID, versionID).Deployment = d
+	if ended != nil {
+		(*s.app(poolID, appID).History)[ended.ID] = ended
+	}
+	return nil
+}
+
+func (s *State) DeletePool(id string) error {
+	f, err := poolFile(id)
+	if err != nil {
+		return err
+	}
+	if err := s.commit(id, "Delete pool "+id, change{path.Dir(f), nil}); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pools, id)
+	delete(s.drift, id)
+	return nil
+}
+
+func (s *State) DeleteApp(poolID, id string) error {
+	f, err := appFile(poolID, id)
+	if err != nil {
+		return err
+	}
+	if err := s.commit(poolID, "Delete app "+poolID+"/"+id, change{path.Dir(f), nil}); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if p, ok := s.pools[poolID]; ok {
+		delete(*p.Apps, id)
+	}
+	return nil
+}
+
+func (s *State) DeleteVersion(poolID, appID, id string) error {
+	vf, err := versionFile(poolID, appID, id)
+	if err != nil {
+		return err
+	}
+	df, err := deploymentFile(poolID, appID, id)
+	if err != nil {
+		return err
+	}
+	if err := s.commit(poolID, "Delete version "+poolID+"/"+appID+"/"+id, change{vf, nil}, change{df, nil}); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if a := s.app(poolID, appID); a != nil {
+		delete(*a.Versions, id)
+	}
+	return nil
+}
+
+// app and version must be called with s locked.
+func (s *State) app(poolID, id string) *App {
+	if p, ok := s.pools[poolID]; ok {
+		return (*p.Apps)[id]
+	}
+	return nil
+}
+
+func (s *State) version(poolID, appID, id string) *Version {
+	if a := s.app(poolID, appID); a != nil {
+		return (*a.Versions)[id]
+	}
+	return nil
+}
+
+// change is a file to write to the state repo; if entity is nil the file,
+// or directory, is removed instead.
+type change struct {
+	file   string
+	entity interface{}
+}
+
+// commit makes changes to a pool in the state repo, and commits and pushes
+// them. While a request holds the pool's lock, they are committed as its
+// actor. Until Load is called, state lives only in memory.
+func (s *State) commit(poolID, message string, changes ...change) error {
+	s.RLock()
+	rec := s.auditing[poolID]
+	s.RUnlock()
+	if rec != nil {
+		return s.commitAs(rec.commitAuthor(), message+"\n\n"+rec.commitTrailers(), changes...)
+	}
+	return s.commitAs("", message, changes...)
+}
+
+// commitAs is commit with the given author, e.g. "Name <email>", or the
+// repo's own identity if author is empty.
+func (s *State) commitAs(author, message string, changes ...change) error {
+	if s.repo == nil {
+		return nil
+	}
+	s.repo.Lock()
+	defer s.repo.Unlock()
+	head := s.repo.Head()
+	err := func() error {
+		for _, c := range changes {
+			var err error
+			if c.entity == nil {
+				err = s.repo.Remove(c.file)
+			} else {
+				err = s.repo.WriteJSON(c.file, c.entity)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return s.repo.CommitAs(author, message)
+	}()
+	if err != nil {
+		// Leave nothing behind for the next commit to pick up.
+		if err := s.repo.ResetTo(head); err != nil {
+			log.Error(err)
+		}
+	}
+	return err
+}
+
+// The clone methods make copies deep enough that nothing in the copy is
+// modified by later changes to the state.
+func (p *Pool) clone() *Pool {
+	c := *p
+	if p.Apps != nil {
+		apps := make(Apps, len(*p.Apps))
+		for id, a := range *p.Apps {
+			apps[id] = a.clone()
+		}
+		c.Apps = &apps
+	}
+	return &c
+}
+
+func (a *App) clone() *App {
+	c := *a
+	if a.History != nil {
+		// Events are replaced rather than changed, so they can be shared.
+		history := make(History, len(*a.History))
+		for id, e := range *a.History {
+			history[id] = e
+		}
+		c.History = &history
+	}
+	if a.Versions != nil {
+		versions := make(Versions, len(*a.Versions))
+		for id, v := range *a.Versions {
+			versions[id] = v.clone()
+		}
+		c.Versions = &versions
+	}
+	return &c
+}
+
+func (v *Version) clone() *Version {
+	c := *v
+	if v.Deployment != nil {
+		c.Deployment = v.Deployment.clone()
+	}
+	return &c
+}
+
+func (d *Deployment) clone() *Deployment {
+	c := *d
+	if d.Rollout != nil {
+		r := *d.Rollout
+		c.Rollout = &r
+	}
+	if d.Scaling != nil {
+		s := *d.Scaling
+		c.Scaling = &s
+	}
+	if d.Bake != nil {
+		b := *d.Bake
+		c.Bake = &b
+	}
+	if d.Cutover != nil {
+		co := *d.Cutover
+		c.Cutover = &co
+	}
+	c.Transitions = append([]Transition(nil), d.Transitions...)
+	return &c
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// parallel runs each of fs at once, and waits for them all.
+func parallel(fs ...func()) {
+	var wg sync.WaitGroup
+	for _, f := range fs {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentPutsAcrossPools(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	puts := []func(){}
+	for i := 0; i < 8; i++ {
+		pool := fmt.Sprintf("p%d", i)
+		f := newFakeMarathon()
+		defer f.Close()
+		puts = append(puts, func() {
+			for _, put := range [][2]string{
+				{"/pools/" + pool, `{"marathonHost": "` + f.URL + `"}`},
+				{"/pools/" + pool + "/apps/web", `{}`},
+				{"/pools/" + pool + "/apps/web/versions/1", `{"command": ["./web"], "minInstances": 1}`},
+				{"/pools/" + pool, `{"marathonHost": "` + f.URL + `", "env": {"POOL": "` + pool + `"}}`},
+			} {
+				if status, body := request(t, s, "PUT", put[0], put[1]); status != 200 && status != 201 {
+					t.Errorf("PUT %s: %d %s", put[0], status, body)
+				}
+			}
+		})
+	}
+	parallel(puts...)
+	if ids := state.GetPoolIDs(); len(ids) != 8 {
+		t.Fatalf("got pools %v, want 8", ids)
+	}
+	for _, id := range state.GetPoolIDs() {
+		p := state.GetPool(id)
+		if p.Env["POOL"] != id || state.GetVersion(id, "web", "1") == nil {
+			t.Errorf("pool %s: got env %v, version 1 %v", id, p.Env, state.GetVersion(id, "web", "1"))
+		}
+	}
+}
+
+func TestConcurrentPutsWithinPool(t *testing.T) {
+	f := newFakeMarathon()
+	defer f.Close()
+	s := newTestServer(t)
+	defer s.Close()
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	puts := []func(){}
+	for i := 0; i < 8; i++ {
+		app, version := fmt.Sprintf("app%d", i), fmt.Sprintf("%d", i)
+		puts = append(puts, func() {
+			if status, body := request(t, s, "PUT", "/pools/p/apps/"+app, `{}`); status != 201 {
+				t.Errorf("PUT app %s: %d %s", app, status, body)
+			}
+		}, func() {
+			path := "/pools/p/apps/web/versions/" + version
+			if status, body := request(t, s, "PUT", path, `{"command": ["./web"], "minInstances": 1}`); status != 201 {
+				t.Errorf("PUT %s: %d %s", path, status, body)
+			}
+		})
+	}
+	parallel(puts...)
+	app := state.GetApp("p", "web")
+	if n := len(*state.GetPool("p").Apps); n != 9 {
+		t.Errorf("got %d apps, want 9", n)
+	}
+	if n := len(*app.Versions); n != 8 {
+		t.Errorf("got %d versions, want 8", n)
+	}
+	// Each deploy superseded the one before it, so only the last is live.
+	currentID, _ := app.current()
+	for id, v := range *app.Versions {
+		if id != currentID && v.Deployment.Status != Superseded {
+			t.Errorf("version %s is %s, though %s was deployed after it", id, v.Deployment.Status, currentID)
+		}
+	}
+	if got := f.app("/web").Labels["version"]; got != currentID {
+		t.Errorf("Marathon is running version %s, want %s", got, currentID)
+	}
+}
+
+func TestLockPool(t *testing.T) {
+	resetState()
+	unlock := state.LockPool("a")
+	other := make(chan bool)
+	go func() {
+		defer state.LockPool("b")()
+		other <- true
+	}()
+	select {
+	case <-other:
+	case <-time.After(time.Second):
+		t.Fatal("locking pool b waited for pool a")
+	}
+	same := make(chan bool)
+	go func() {
+		defer state.LockPool("a")()
+		same <- true
+	}()
+	select {
+	case <-same:
+		t.Fatal("pool a was locked twice at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-same:
+	case <-time.After(time.Second):
+		t.Fatal("pool a was not unlocked")
+	}
+}
+
+func TestStateFilesRefuseInvalidIDs(t *testing.T) {
+	for _, id := range []string{"", ".", "..", "a/b", "../x", "*", "a b"} {
+		if f, err := poolFile(id); err == nil {
+			t.Errorf("pool %q: got %s, want an error", id, f)
+		}
+		if f, err := versionFile("p", "web", id); err == nil {
+			t.Errorf("version %q: got %s, want an error", id, f)
+		}
+	}
+	if f, err := appFile("p", "web.api_2-b"); err != nil || f != "pools/p/apps/web.api_2-b/app.json" {
+		t.Errorf("got %s, %v", f, err)
+	}
+}
+
+// useTestRepo keeps the state in a clone of a new, empty repo until the test
+// ends, and returns the path of the repo and the clone.
+func useTestRepo(t *testing.T) (string, *gitRepo) {
+	remote := t.TempDir()
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+	repo, err := cloneGitRepo(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.repo = repo
+	t.Cleanup(func() {
+		state.repo = nil
+		os.RemoveAll(repo.Dir)
+	})
+	return remote, repo
+}
+
+// remoteFiles lists the files in the repo at remote, one per line.
+func remoteFiles(t *testing.T, remote string) string {
+	out, err := exec.Command("git", "--git-dir", remote, "ls-tree", "-r", "--name-only", "HEAD").CombinedOutput()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	return string(out)
+}
+
+func TestFailedCommitChangesNothing(t *testing.T) {
+	resetState()
+	remote, repo := useTestRepo(t)
+	if err := state.SetPool("p", &Pool{}); err != nil {
+		t.Fatal(err)
+	}
+	head := repo.Head()
+	repo.git("remote", "set-url", "origin", remote+"-gone")
+	if err := state.SetPool("q", &Pool{}); err == nil {
+		t.Fatal("got no error pushing to a remote that isn't there")
+	}
+	if err := state.DeletePool("p"); err == nil {
+		t.Fatal("got no error pushing to a remote that isn't there")
+	}
+	if state.GetPool("q") != nil || state.GetPool("p") == nil {
+		t.Errorf("got pools %v, want just p", state.GetPoolIDs())
+	}
+	if got := repo.Head(); got != head {
+		t.Errorf("HEAD moved from %s to %s", head, got)
+	}
+	if out, _ := repo.git("status", "--porcelain"); out != "" {
+		t.Errorf("got changes left behind: %s", out)
+	}
+	repo.git("remote", "set-url", "origin", remote)
+	if err := state.SetPool("r", &Pool{}); err != nil {
+		t.Fatal(err)
+	}
+	if out := remoteFiles(t, remote); out != "pools/p/pool.json\npools/r/pool.json\n" {
+		t.Errorf("got files %q in the remote, want just pools p and r", out)
+	}
+}
+
+func TestCommitsAreRebasedOntoOthers(t *testing.T) {
+	resetState()
+	remote, _ := useTestRepo(t)
+	if err := state.SetPool("p", &Pool{}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := cloneGitRepo(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other.Dir)
+	if err := other.WriteJSON("README.json", "someone else's change"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Commit("Someone else's change"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetPool("q", &Pool{}); err != nil {
+		t.Fatal(err)
+	}
+	if out := remoteFiles(t, remote); out != "README.json\npools/p/pool.json\npools/q/pool.json\n" {
+		t.Errorf("got files %q in the remote", out)
+	}
+}
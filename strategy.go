@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"github.com/opentable/hat"
+	"time"
+)
+
+type StrategyType string
+
+const (
+	// Replace, the default, has Marathon upgrade the app in place.
+	Replace = StrategyType("")
+	// Rolling brings the new version up alongside the old one, a step at a
+	// time, and only takes each step once the previous one is healthy.
+	Rolling = StrategyType("rolling")
+	// Recreate stops every instance of the old version before starting the
+	// new one.
+	Recreate = StrategyType("recreate")
+	// BlueGreen brings the new version up in full alongside the old one, and
+	// only replaces it once the new version is promoted.
+	BlueGreen = StrategyType("blue-green")
+	// Canary brings up a few instances of the new version alongside the old
+	// one, and replaces the old one with it if they stay healthy for a while.
+	Canary = StrategyType("canary")
+)
+
+// The roles and colours of versions, as shown in the versions collection.
+const (
+	Live      = "live"
+	Candidate = "candidate"
+	Baking    = "canary"
+	Blue      = "blue"
+	Green     = "green"
+)
+
+// Strategy is how a version replaces the one running before it. MaxSurge
+// and MaxUnavailable are numbers of instances, and only apply to rolling
+// deployments; CanaryInstances and BakeTime, e.g. "10m", only to canaries.
+type Strategy struct {
+	Type            StrategyType `json:"type"`
+	MaxSurge        int          `json:"maxSurge,omitempty"`
+	MaxUnavailable  int          `json:"maxUnavailable,omitempty"`
+	CanaryInstances int          `json:"canaryInstances,omitempty"`
+	BakeTime        string       `json:"bakeTime,omitempty"`
+}
+
+// surge is MaxSurge, except that a rolling deployment that may neither
+// surge nor be unavailable would never get anywhere, so it surges by one.
+func (s Strategy) surge() int {
+	if s.MaxSurge == 0 && s.MaxUnavailable == 0 {
+		return 1
+	}
+	return s.MaxSurge
+}
+
+// Rollout is the progress of a rolling deployment from one version to
+// another. Old and New are the instances each has been scaled to so far.
+type Rollout struct {
+	From              string    `json:"from"`
+	FromMarathonAppID string    `json:"fromMarathonAppId"`
+	FromInstances     int       `json:"fromInstances"`
+	Old               int       `json:"oldInstances"`
+	New               int       `json:"newInstances"`
+	StepStarted       time.Time `json:"stepStarted"`
+}
+
+// startRollout records in d that the version it deploys, in a Marathon app
+// of its own with no instances yet, is to be rolled out in place of the from
+// version, which runs in fromApp.
+func startRollout(d *Deployment, from string, fromApp *marathonApp) {
+	d.Rollout = &Rollout{from, fromApp.ID, fromApp.Instances, fromApp.Instances, 0, time.Now().UTC()}
+}
+
+// reconcileRollout takes the next step of a rolling deployment, once the
+// last step is complete and the new version's instances are all ready. It
+// scales the new version up as far as MaxSurge allows, or else scales the
+// old version down as far as MaxUnavailable allows. Once the old version is
+// gone, it is superseded. If a step doesn't become ready in time, the old
+// version is restored. It returns true if d changed. The caller must hold
+// the pool's lock.
+func reconcileRollout(m *marathon, poolID, appID, versionID string, v *Version, running map[string]bool) (bool, error) {
+	d, r := v.Deployment, v.Deployment.Rollout
+	timedOut := time.Since(r.StepStarted) > deploymentTimeout
+	if running[d.MarathonID] {
+		if timedOut {
+			return abortRollout(m, d, "step not complete after "+deploymentTimeout.String())
+		}
+		return d.transition(Deploying, ""), nil
+	}
+	app, err := m.GetApp(d.MarathonAppID)
+	if err == errMarathonNotFound {
+		return abortRollout(m, d, "app no longer exists in Marathon")
+	} else if err != nil {
+		return false, err
+	}
+	if app.ready() < r.New {
+		if timedOut {
+			return abortRollout(m, d, "not healthy after "+deploymentTimeout.String())
+		}
+		return false, nil
+	}
+	n := v.MinInstances
+	newTarget := n + v.Strategy.surge() - r.Old
+	if newTarget > n {
+		newTarget = n
+	}
+	oldTarget := n - v.Strategy.MaxUnavailable - r.New
+	if oldTarget < 0 {
+		oldTarget = 0
+	}
+	if newTarget > r.New {
+		if d.MarathonID, err = m.Scale(d.MarathonAppID, newTarget); err != nil {
+			return false, err
+		}
+		r.New = newTarget
+	} else if oldTarget < r.Old {
+		if d.MarathonID, err = m.Scale(r.FromMarathonAppID, oldTarget); err != nil {
+			return false, err
+		}
+		r.Old = oldTarget
+	} else {
+		return finishRollout(m, poolID, appID, versionID, d)
+	}
+	r.StepStarted = time.Now().UTC()
+	d.Reason = fmt.Sprintf("%d of %d new instances, %d old", r.New, n, r.Old)
+	return true, nil
+}
+
+func finishRollout(m *marathon, poolID, appID, versionID string, d *Deployment) (bool, error) {
+	r := d.Rollout
+	if r.FromMarathonAppID != d.MarathonAppID {
+		if err := m.Delete(r.FromMarathonAppID); err != nil {
+			return false, err
+		}
+	}
+	if from := state.GetVersion(poolID, appID, r.From); from != nil && from.Deployment != nil {
+		if from.Deployment.transition(Superseded, "version "+versionID+" was deployed") {
+			if err := state.SetDeployment(poolID, appID, r.From, from.Deployment); err != nil {
+				return false, err
+			}
+		}
+	}
+	return d.transition(Healthy, ""), nil
+}
+
+// abortRollout puts the old version back as it was, and removes the new one.
+func abortRollout(m *marathon, d *Deployment, reason string) (bool, error) {
+	r := d.Rollout
+	if r.Old != r.FromInstances {
+		if _, err := m.Scale(r.FromMarathonAppID, r.FromInstances); err != nil {
+			return false, err
+		}
+		r.Old = r.FromInstances
+	}
+	if err := m.Delete(d.MarathonAppID); err != nil {
+		return false, err
+	}
+	r.New = 0
+	return d.transition(Failed, reason+"; restored version "+r.From), nil
+}
+
+// Cutover is the progress of a blue-green deployment. Until it is
+// promoted, the version it is to replace stays live.
+type Cutover struct {
+	Colour            string `json:"colour"`
+	From              string `json:"from"`
+	FromMarathonAppID string `json:"fromMarathonAppId"`
+	Promoted          bool   `json:"promoted"`
+}
+
+// candidate is true for a blue-green deployment that may yet be promoted.
+func (d *Deployment) candidate() bool {
+	return d.Cutover != nil && !d.Cutover.Promoted && d.Status != Failed && d.Status != Superseded
+}
+
+// startBlueGreen records in d that the version it deploys, in full in the
+// Marathon app of whichever colour fromApp isn't, is a candidate to replace
+// the from version.
+func startBlueGreen(appID string, d *Deployment, from string, fromApp *marathonApp) {
+	d.Cutover = &Cutover{otherColour(appID, fromApp.ID), from, fromApp.ID, false}
+}
+
+// name is the strategy's type, or "replace" for the default.
+func (t StrategyType) name() string {
+	if t == Replace {
+		return "replace"
+	}
+	return string(t)
+}
+
+// otherColour is the colour of the Marathon app that isn't fromAppID.
+func otherColour(appID, fromAppID string) string {
+	if fromAppID == marathonColourAppID(appID, Green) {
+		return Blue
+	}
+	return Green
+}
+
+// reconcileBlueGreen is reconcileDeployment, except that a candidate that
+// fails is removed from Marathon.
+func reconcileBlueGreen(m *marathon, appID, versionID string, d *Deployment, running map[string]bool) (bool, error) {
+	changed, err := reconcileDeployment(m, appID, versionID, d, running)
+	if err == nil && changed && d.Status == Failed {
+		err = m.Delete(d.MarathonAppID)
+	}
+	return changed, err
+}
+
+// promoteVersion makes a healthy blue-green candidate live, and removes the
+// version it replaces. The caller must hold the pool's lock.
+func promoteVersion(poolID, appID, versionID, reason, actor string) error {
+	v, err := getPromotable(poolID, appID, versionID)
+	if err != nil {
+		return err
+	}
+	d := v.Deployment
+	c := d.Cutover
+	if err := newMarathon(state.GetPool(poolID).MarathonHost).Delete(c.FromMarathonAppID); err != nil {
+		return hat.HttpError(502, "Unable to delete", c.FromMarathonAppID, "from Marathon:", err)
+	}
+	if from := state.GetVersion(poolID, appID, c.From); from != nil && from.Deployment != nil {
+		if from.Deployment.transition(Superseded, "version "+versionID+" was promoted") {
+			if err := state.SetDeployment(poolID, appID, c.From, from.Deployment); err != nil {
+				return err
+			}
+		}
+	}
+	c.Promoted = true
+	if err := state.SetDeployment(poolID, appID, versionID, d); err != nil {
+		return err
+	}
+	return state.AddEvent(poolID, appID, &Event{Type: "promote", Version: versionID, From: c.From, Actor: actor, Reason: reason, At: time.Now().UTC()})
+}
+
+// abortVersion removes a blue-green candidate, leaving the version it was to
+// replace live. The caller must hold the pool's lock.
+func abortVersion(poolID, appID, versionID, reason, actor string) error {
+	v, err := getCandidate(poolID, appID, versionID)
+	if err != nil {
+		return err
+	}
+	d := v.Deployment
+	if err := newMarathon(state.GetPool(poolID).MarathonHost).Delete(d.MarathonAppID); err != nil {
+		return hat.HttpError(502, "Unable to delete", d.MarathonAppID, "from Marathon:", err)
+	}
+	why := "aborted"
+	if reason != "" {
+		why += ": " + reason
+	}
+	d.transition(Failed, why)
+	if err := state.SetDeployment(poolID, appID, versionID, d); err != nil {
+		return err
+	}
+	return state.AddEvent(poolID, appID, &Event{Type: "abort", Version: versionID, From: d.Cutover.From, Actor: actor, Reason: reason, At: time.Now().UTC()})
+}
+
+// getPromotable returns the version if it is a healthy blue-green candidate,
+// and a 409 otherwise.
+func getPromotable(poolID, appID, versionID string) (*Version, error) {
+	v, err := getCandidate(poolID, appID, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if d := v.Deployment; d.Status != Healthy {
+		return nil, hat.HttpError(409, "Version", versionID, "is", string(d.Status)+"; only healthy versions can be promoted.")
+	}
+	return v, nil
+}
+
+func getCandidate(poolID, appID, versionID string) (*Version, error) {
+	v := state.GetVersion(poolID, appID, versionID)
+	if v == nil {
+		return nil, notFound("Version", poolID+"/"+appID+"/"+versionID)
+	}
+	if v.Deployment == nil || !v.Deployment.candidate() {
+		return nil, hat.HttpError(409, "Version", versionID, "is not a blue-green candidate.")
+	}
+	return v, nil
+}
+
+// annotate fills in the fields of the app's versions that are worked out
+// rather than stored: which version is live and which, if any, is a
+// blue-green candidate, and their colours, or a canary, and how the live
+// version has been autoscaled.
+func (a *App) annotate() {
+	_, live := a.current()
+	if live != nil {
+		live.Role = Live
+		if live.Deployment.Cutover != nil {
+			live.Colour = live.Deployment.Cutover.Colour
+		}
+		live.Scaling = live.Deployment.Scaling
+	}
+	for _, v := range *a.Versions {
+		if v.Deployment != nil && v.Deployment.baking() {
+			v.Role = Baking
+		}
+		if v.Deployment == nil || !v.Deployment.candidate() {
+			continue
+		}
+		v.Role, v.Colour = Candidate, v.Deployment.Cutover.Colour
+		if live != nil {
+			live.Colour = Blue
+			if v.Colour == Blue {
+				live.Colour = Green
+			}
+		}
+	}
+}
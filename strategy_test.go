@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startRolloutTest deploys version 1 of an app with 4 instances, and once it
+// is healthy, starts rolling out version 2 in its place with strategy.
+// Marathon is stuck from then on if stuck is true.
+func startRolloutTest(t *testing.T, strategy string, stuck bool) (*fakeMarathon, *httptest.Server, func()) {
+	f := newFakeMarathon()
+	s := newTestServer(t)
+	mustRequest(t, s, "PUT", "/pools/p", `{"marathonHost": "`+f.URL+`"}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web", `{}`)
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/1", `{"command": ["./web"], "minInstances": 4}`)
+	reconcilePoolDeployments("p")
+	f.stuck = stuck
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/2", `{"command": ["./web", "-v2"], "minInstances": 4, "strategy": `+strategy+`}`)
+	return f, s, func() {
+		s.Close()
+		f.Close()
+	}
+}
+
+// instances is how many instances the Marathon app with id has, or -1 if
+// there is no such app.
+func instances(f *fakeMarathon, id string) int {
+	if a := f.app(id); a != nil {
+		return a.Instances
+	}
+	return -1
+}
+
+func TestRolloutSteps(t *testing.T) {
+	for _, c := range []struct {
+		strategy string
+		steps    []string
+	}{
+		{`{"type": "rolling", "maxSurge": 2, "maxUnavailable": 1}`, []string{"2 new, 4 old", "2 new, 1 old", "4 new, 1 old", "4 new, 0 old"}},
+		{`{"type": "rolling", "maxSurge": 1}`, []string{"1 new, 4 old", "1 new, 3 old", "2 new, 3 old", "2 new, 2 old",
+			"3 new, 2 old", "3 new, 1 old", "4 new, 1 old", "4 new, 0 old"}},
+		{`{"type": "rolling", "maxUnavailable": 2}`, []string{"0 new, 2 old", "2 new, 2 old", "2 new, 0 old", "4 new, 0 old"}},
+		{`{"type": "rolling"}`, []string{"1 new, 4 old", "1 new, 3 old", "2 new, 3 old", "2 new, 2 old",
+			"3 new, 2 old", "3 new, 1 old", "4 new, 1 old", "4 new, 0 old"}},
+	} {
+		f, _, done := startRolloutTest(t, c.strategy, false)
+		d := state.GetVersion("p", "web", "2").Deployment
+		steps := []string{}
+		for i := 0; i < 20 && d.Status != Healthy; i++ {
+			reconcilePoolDeployments("p")
+			if d = state.GetVersion("p", "web", "2").Deployment; d.Status != Healthy {
+				r := d.Rollout
+				if instances(f, "/web-2") != r.New || instances(f, "/web") != r.Old {
+					t.Errorf("%s: Marathon has %d new and %d old, but the rollout has %d and %d", c.strategy,
+						instances(f, "/web-2"), instances(f, "/web"), r.New, r.Old)
+				}
+				steps = append(steps, fmt.Sprintf("%d new, %d old", r.New, r.Old))
+			}
+		}
+		if !reflect.DeepEqual(steps, c.steps) {
+			t.Errorf("%s: got steps %q, want %q", c.strategy, steps, c.steps)
+		}
+		if d.Status != Healthy || f.app("/web") != nil || instances(f, "/web-2") != 4 {
+			t.Errorf("%s: got %s, with %d old and %d new instances; want healthy, with 4 new alone", c.strategy, d.Status,
+				instances(f, "/web"), instances(f, "/web-2"))
+		}
+		if d := state.GetVersion("p", "web", "1").Deployment; d.Status != Superseded {
+			t.Errorf("%s: version 1 is %s, want superseded", c.strategy, d.Status)
+		}
+		done()
+	}
+}
+
+func TestRolloutTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { deploymentTimeout = timeout }(deploymentTimeout)
+	f, _, done := startRolloutTest(t, `{"type": "rolling", "maxSurge": 2, "maxUnavailable": 1}`, false)
+	defer done()
+	reconcilePoolDeployments("p")
+	f.stuck = true
+	reconcilePoolDeployments("p")
+	if instances(f, "/web") != 1 {
+		t.Fatalf("got %d old instances, want 1 before the timeout", instances(f, "/web"))
+	}
+	deploymentTimeout = 0
+	reconcilePoolDeployments("p")
+	d := state.GetVersion("p", "web", "2").Deployment
+	if d.Status != Failed || !strings.Contains(d.Reason, "restored version 1") {
+		t.Errorf("got %s, %q; want failed, restoring version 1", d.Status, d.Reason)
+	}
+	if instances(f, "/web") != 4 || f.app("/web-2") != nil {
+		t.Errorf("got %d old instances, and new app %+v; want 4, and none", instances(f, "/web"), f.app("/web-2"))
+	}
+	if liveID, _ := state.GetApp("p", "web").current(); liveID != "1" {
+		t.Errorf("live version is %q, want 1", liveID)
+	}
+}
+
+func TestBlueGreenPromote(t *testing.T) {
+	f, s, done := startRolloutTest(t, `{"type": "blue-green"}`, true)
+	defer done()
+	reconcilePoolDeployments("p")
+	if instances(f, "/web-green") != 4 || instances(f, "/web") != 4 {
+		t.Fatalf("got %d green and %d live instances, want 4 of each", instances(f, "/web-green"), instances(f, "/web"))
+	}
+	if status, body := request(t, s, "POST", "/pools/p/apps/web/versions/2/promote", `{}`); status != 409 {
+		t.Errorf("promoting a candidate that isn't healthy: got %d %s, want 409", status, body)
+	}
+
+	f.finish()
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "POST", "/pools/p/apps/web/versions/2/promote", `{"reason": "looks good"}`)
+	if f.app("/web") != nil || instances(f, "/web-green") != 4 {
+		t.Errorf("got %d old and %d green instances, want the green ones alone", instances(f, "/web"), instances(f, "/web-green"))
+	}
+	if d := state.GetVersion("p", "web", "1").Deployment; d.Status != Superseded {
+		t.Errorf("version 1 is %s, want superseded", d.Status)
+	}
+	if liveID, _ := state.GetApp("p", "web").current(); liveID != "2" {
+		t.Errorf("live version is %q, want 2", liveID)
+	}
+	if e := lastEvent(t, "p", "web"); e.Type != "promote" || e.Version != "2" || e.From != "1" || e.Reason != "looks good" {
+		t.Errorf("got event %+v, want version 2 promoted from 1", e)
+	}
+
+	// The next candidate is blue.
+	mustRequest(t, s, "PUT", "/pools/p/apps/web/versions/3", `{"command": ["./web", "-v3"], "minInstances": 4, "strategy": {"type": "blue-green"}}`)
+	if instances(f, "/web-blue") != 4 || instances(f, "/web-green") != 4 {
+		t.Errorf("got %d blue and %d green instances, want 4 of each", instances(f, "/web-blue"), instances(f, "/web-green"))
+	}
+}
+
+func TestBlueGreenAbort(t *testing.T) {
+	f, s, done := startRolloutTest(t, `{"type": "blue-green"}`, false)
+	defer done()
+	reconcilePoolDeployments("p")
+	mustRequest(t, s, "POST", "/pools/p/apps/web/versions/2/abort", `{"reason": "not today"}`)
+	if f.app("/web-green") != nil {
+		t.Error("the candidate is still in Marathon")
+	}
+	if a := f.app("/web"); a == nil || a.Instances != 4 || a.Labels["version"] != "1" {
+		t.Errorf("got %+v, want version 1 untouched", a)
+	}
+	if d := state.GetVersion("p", "web", "2").Deployment; d.Status != Failed || !strings.Contains(d.Reason, "not today") {
+		t.Errorf("got %s, %q; want failed, with the reason", d.Status, d.Reason)
+	}
+	if liveID, _ := state.GetApp("p", "web").current(); liveID != "1" {
+		t.Errorf("live version is %q, want 1", liveID)
+	}
+	for _, action := range []string{"promote", "abort"} {
+		if status, body := request(t, s, "POST", "/pools/p/apps/web/versions/2/"+action, `{}`); status != 409 {
+			t.Errorf("%s after aborting: got %d %s, want 409", action, status, body)
+		}
+	}
+}
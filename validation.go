@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/opentable/hat"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// validID matches the IDs of pools, apps and versions. IDs name directories
+// and files in the state repo, so they mustn't be able to reach outside them.
+var validID = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+const validIDRule = "must be letters, digits, '.', '_' and '-', and not '.' or '..'"
+
+// checkIDs returns an error unless every one of ids is valid.
+func checkIDs(ids ...string) error {
+	for _, id := range ids {
+		if id == "." || id == ".." || !validID.MatchString(id) {
+			return hat.HttpError(400, "ID", quot(id), "is invalid; IDs", validIDRule+".")
+		}
+	}
+	return nil
+}
+
+// validateID checks the ID of an entity, from the URL.
+func validateID(ve *hat.ValidationError, field, id string) {
+	if checkIDs(id) != nil {
+		ve.Add(field, quot(id), "in the URL", validIDRule)
+	}
+}
+
+func (p *Pool) Validate(_ *Pools, name string) error {
+	ve := hat.NewValidationError("Pool", name, "is invalid.")
+	validateID(ve, "name", name)
+	validateName(ve, "name", p.Name, name)
+	if p.MarathonHost == "" {
+		ve.Add("marathonHost", "is required")
+	} else if u, err := url.Parse(newMarathon(p.MarathonHost).URL); err != nil || u.Host == "" {
+		ve.Add("marathonHost", "is not a host:port or URL")
+	}
+	validateEnv(ve, p.Env)
+	validatePolicy(ve, p.Policy)
+	if p.DriftMode != DriftReport && p.DriftMode != DriftCorrect {
+		ve.Add("driftMode", "must be empty, to report drift, or", quot(string(DriftCorrect)))
+	}
+	return ve.OrNil()
+}
+
+func (a *App) Validate(_ *Apps, name string) error {
+	ve := hat.NewValidationError("App", name, "is invalid.")
+	validateID(ve, "name", name)
+	validateName(ve, "name", a.Name, name)
+	validateEnv(ve, a.Env)
+	return ve.OrNil()
+}
+
+func (v *Version) Validate(_ *Versions, name string, path []string) error {
+	poolID, appID, _ := pathIDs(path)
+	ve := hat.NewValidationError("Version", name, "is invalid.")
+	validateID(ve, "version", name)
+	validateName(ve, "version", v.Version, name)
+	validateName(ve, "appName", v.AppName, appID)
+	if len(v.Command) == 0 || v.Command[0] == "" {
+		ve.Add("command", "is required")
+	}
+	for _, a := range v.ArtifactURLs {
+		if u, err := url.Parse(a); err != nil || !u.IsAbs() {
+			ve.Add("artifactUrls", quot(a), "is not an absolute URL")
+		}
+	}
+	if v.HealthURI != "" {
+		if u, err := url.Parse(v.HealthURI); err != nil || u.IsAbs() || !strings.HasPrefix(u.Path, "/") {
+			ve.Add("healthUri", "must be a path starting with /")
+		}
+	}
+	if v.MinInstances < 0 {
+		ve.Add("minInstances", "must not be negative")
+	}
+	// MaxInstances is optional; zero means there is no more than the minimum.
+	if v.MaxInstances != 0 && v.MaxInstances < v.MinInstances {
+		ve.Add("maxInstances", "must not be less than minInstances")
+	}
+	validateEnv(ve, v.Env)
+	validateRequirements(ve, v.Requirements)
+	validateStrategy(ve, v.Strategy)
+	if v.Autoscale != nil {
+		validateAutoscale(ve, v)
+	}
+	if pool := state.GetPool(poolID); pool != nil {
+		checkPolicy(ve, pool, poolID, appID, v)
+	}
+	return ve.OrNil()
+}
+
+func validateAutoscale(ve *hat.ValidationError, v *Version) {
+	a := v.Autoscale
+	if !strings.HasPrefix(a.MetricURI, "/") {
+		ve.Add("autoscale.metricUri", "must be a path starting with /")
+	}
+	if a.Target <= 0 {
+		ve.Add("autoscale.target", "must be positive")
+	}
+	if a.Tolerance < 0 || a.Tolerance >= 1 {
+		ve.Add("autoscale.tolerance", "must be at least 0 and less than 1")
+	}
+	if a.Cooldown != "" {
+		if d, err := time.ParseDuration(a.Cooldown); err != nil || d < 0 {
+			ve.Add("autoscale.cooldown", quot(a.Cooldown), "is not a duration like 3m")
+		}
+	}
+	if v.MaxInstances <= v.MinInstances {
+		ve.Add("maxInstances", "must be more than minInstances to autoscale")
+	}
+}
+
+func validateStrategy(ve *hat.ValidationError, s Strategy) {
+	switch s.Type {
+	case Replace, Rolling, Recreate, BlueGreen, Canary:
+	default:
+		ve.Add("strategy.type", quot(string(s.Type)), "is not one of rolling, recreate, blue-green or canary")
+	}
+	if s.CanaryInstances < 0 {
+		ve.Add("strategy.canaryInstances", "must not be negative")
+	}
+	if s.BakeTime != "" {
+		if d, err := time.ParseDuration(s.BakeTime); err != nil || d < 0 {
+			ve.Add("strategy.bakeTime", quot(s.BakeTime), "is not a duration like 10m")
+		}
+	}
+	if s.MaxSurge < 0 {
+		ve.Add("strategy.maxSurge", "must not be negative")
+	}
+	if s.MaxUnavailable < 0 {
+		ve.Add("strategy.maxUnavailable", "must not be negative")
+	}
+}
+
+func validateRequirements(ve *hat.ValidationError, r Requirements) {
+	if r.CPU < 0 {
+		ve.Add("requirements.CPU", "must not be negative")
+	}
+	if r.MemoryMB < 0 {
+		ve.Add("requirements.MemoryMB", "must not be negative")
+	}
+	if r.DiskMB < 0 {
+		ve.Add("requirements.DiskMB", "must not be negative")
+	}
+	if r.Ports < 0 {
+		ve.Add("requirements.Ports", "must not be negative")
+	}
+	for _, p := range r.SpecificPorts {
+		if p < 1 || p > 65535 {
+			ve.Add("requirements.SpecificPorts", p, "is not a valid port")
+		}
+	}
+}
+
+// validateName checks that a name in the payload, which is optional,
+// matches the name in the URL.
+func validateName(ve *hat.ValidationError, field, name, urlName string) {
+	if name != "" && name != urlName {
+		ve.Add(field, quot(name), "does not match", quot(urlName), "in the URL")
+	}
+}
+
+func quot(s string) string {
+	return "'" + s + "'"
+}